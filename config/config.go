@@ -3,18 +3,126 @@ package config
 import (
 	"mama/log"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	LogLevel string    `yaml:"logLevel" json:"logLevel"`
-	Addr     string    `yaml:"addr" json:"addr"`
-	Port     int       `yaml:"port" json:"port"`
-	Dir      string    `yaml:"dir" json:"dir"`
-	Users    []string  `yaml:"users" json:"users"`
-	BasePath string    `yaml:"basePath" json:"basePath"`
-	Frontend *Frontend `yaml:"frontend" json:"frontend"`
+	LogLevel  string    `yaml:"logLevel" json:"logLevel"`
+	Addr      string    `yaml:"addr" json:"addr"`
+	Port      int       `yaml:"port" json:"port"`
+	Dir       string    `yaml:"dir" json:"dir"`
+	Users     []string  `yaml:"users" json:"users"`
+	BasePath  string    `yaml:"basePath" json:"basePath"`
+	Frontend  *Frontend `yaml:"frontend" json:"frontend"`
+	Index     Index     `yaml:"index" json:"index"`
+	FullText  FullText  `yaml:"fullText" json:"fullText"`
+	Watch     Watch     `yaml:"watch" json:"watch"`
+	Mime      Mime      `yaml:"mime" json:"mime"`
+	Exif      Exif      `yaml:"exif" json:"exif"`
+	Transform Transform `yaml:"transform" json:"transform"`
+	HLS       HLS       `yaml:"hls" json:"hls"`
+}
+
+type HLS struct {
+	// any GET request of ?hls may start a transcode, so it is disabled by
+	// default
+	Enable     bool        `yaml:"enable" json:"enable"`
+	Renditions []Rendition `yaml:"renditions" json:"renditions"`
+	// target duration of segments
+	SegmentDuration time.Duration `yaml:"segmentDuration" json:"segmentDuration"`
+	// max number of transcodes run in parallel, at least 1
+	MaxJobs int `yaml:"maxJobs" json:"maxJobs"`
+	// transcodes not requested in IdleTimeout are stopped and removed
+	IdleTimeout time.Duration `yaml:"idleTimeout" json:"idleTimeout"`
+	// finished transcodes not requested in MaxAge are removed
+	MaxAge time.Duration `yaml:"maxAge" json:"maxAge"`
+}
+
+type Rendition struct {
+	Name         string `yaml:"name" json:"name"`
+	Height       int    `yaml:"height" json:"height"`
+	VideoBitrate string `yaml:"videoBitrate" json:"videoBitrate"`
+	AudioBitrate string `yaml:"audioBitrate" json:"audioBitrate"`
+}
+
+type Transform struct {
+	// max number of transforms run in parallel, the number of cpus if 0
+	Workers int `yaml:"workers" json:"workers"`
+	// max waiting time for a free worker
+	QueueTimeout time.Duration `yaml:"queueTimeout" json:"queueTimeout"`
+	// the least recently used results are removed once the cache is larger
+	// than CacheMaxSize bytes, or not used in CacheMaxAge. 0 is unlimited
+	CacheMaxSize       int64         `yaml:"cacheMaxSize" json:"cacheMaxSize"`
+	CacheMaxAge        time.Duration `yaml:"cacheMaxAge" json:"cacheMaxAge"`
+	CachePruneInterval time.Duration `yaml:"cachePruneInterval" json:"cachePruneInterval"`
+	// named op chains usable with ?p=name instead of ?t=chain
+	Presets map[string]string `yaml:"presets" json:"presets"`
+	// only allow the transforms of presets
+	PresetsOnly bool `yaml:"presetsOnly" json:"presetsOnly"`
+	// images larger than these are not decoded, 0 is unlimited
+	MaxMegapixels float64 `yaml:"maxMegapixels" json:"maxMegapixels"`
+	MaxInputSize  int64   `yaml:"maxInputSize" json:"maxInputSize"`
+	// return errors instead of the original file if a transform fails,
+	// it can also be enabled by request with ?strict
+	Strict bool `yaml:"strict" json:"strict"`
+	// hmac secret of signed transform params, unsigned t params are
+	// ignored if it is set
+	Secret string `yaml:"secret" json:"secret"`
+	// watermarks usable by name in the watermark op
+	Watermarks map[string]Watermark `yaml:"watermarks" json:"watermarks"`
+}
+
+// Watermark is an image or a text, the image is used if both are set.
+type Watermark struct {
+	// image file path, relative paths are relative to dir
+	Image string `yaml:"image" json:"image"`
+	Text  string `yaml:"text" json:"text"`
+	// ttf or otf font file of the text, the go font by default
+	Font     string  `yaml:"font" json:"font"`
+	FontSize float64 `yaml:"fontSize" json:"fontSize"`
+	// hex color of the text
+	Color string `yaml:"color" json:"color"`
+}
+
+type Index struct {
+	// full rescan interval of the file index, 0 disables periodic rescan
+	Interval time.Duration `yaml:"interval" json:"interval"`
+}
+
+type Exif struct {
+	// metadata removed from served images, ?meta and ?geo: keep, location
+	// or all. Images whose metadata can't be removed, e.g. tiff and heic,
+	// are refused unless it is keep
+	Strip string `yaml:"strip" json:"strip"`
+	// strip mode by path prefix, the longest matching prefix wins
+	Rules []ExifRule `yaml:"rules" json:"rules"`
+}
+
+type ExifRule struct {
+	Path  string `yaml:"path" json:"path"`
+	Strip string `yaml:"strip" json:"strip"`
+}
+
+type Mime struct {
+	// max number of cached mime types
+	CacheSize int `yaml:"cacheSize" json:"cacheSize"`
+	// max number of files sniffed in parallel for a listing
+	Workers int `yaml:"workers" json:"workers"`
+}
+
+type Watch struct {
+	Enable bool `yaml:"enable" json:"enable"`
+	// use polling instead of inotify, it is also used if inotify is not usable
+	Poll         bool          `yaml:"poll" json:"poll"`
+	PollInterval time.Duration `yaml:"pollInterval" json:"pollInterval"`
+}
+
+type FullText struct {
+	Enable bool `yaml:"enable" json:"enable"`
+	// files larger than this are not indexed
+	MaxFileSize int64 `yaml:"maxFileSize" json:"maxFileSize"`
 }
 
 type Frontend struct {
@@ -37,6 +145,41 @@ var (
 		Addr: "0.0.0.0",
 		Port: 8000,
 		Dir:  "./",
+		Index: Index{
+			Interval: 10 * time.Minute,
+		},
+		Mime: Mime{
+			CacheSize: 100000,
+			Workers:   8,
+		},
+		Watch: Watch{
+			Enable:       true,
+			PollInterval: 30 * time.Second,
+		},
+		FullText: FullText{
+			Enable:      true,
+			MaxFileSize: 4 << 20,
+		},
+		HLS: HLS{
+			Enable: false,
+			Renditions: []Rendition{
+				{Name: "360p", Height: 360, VideoBitrate: "800k", AudioBitrate: "96k"},
+				{Name: "720p", Height: 720, VideoBitrate: "2800k", AudioBitrate: "128k"},
+				{Name: "1080p", Height: 1080, VideoBitrate: "5000k", AudioBitrate: "192k"},
+			},
+			SegmentDuration: 6 * time.Second,
+			MaxJobs:         2,
+			IdleTimeout:     5 * time.Minute,
+			MaxAge:          7 * 24 * time.Hour,
+		},
+		Transform: Transform{
+			QueueTimeout:       10 * time.Second,
+			MaxMegapixels:      100,
+			MaxInputSize:       100 << 20,
+			CacheMaxSize:       1 << 30,
+			CacheMaxAge:        30 * 24 * time.Hour,
+			CachePruneInterval: time.Hour,
+		},
 	}
 )
 
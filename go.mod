@@ -3,6 +3,9 @@ module mama
 go 1.22.5
 
 require (
+	github.com/HugoSmits86/nativewebp v0.9.3
+	github.com/chai2010/webp v1.4.0
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/gabriel-vasile/mimetype v1.4.8
 	github.com/labstack/echo/v4 v4.13.3
 	github.com/nao1215/imaging v1.0.9
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"mama/config"
 	"mama/log"
 	"mama/server"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -22,6 +25,66 @@ var (
 			return server.Run(cmd.Context(), assetsFS)
 		},
 	}
+	signTTL time.Duration
+	signCmd = &cobra.Command{
+		Use:   "sign <path> <t>",
+		Short: "签名转换参数，输出可访问的 url",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config.Load(configFile)
+			if config.C.Transform.Secret == "" {
+				return errors.New("transform.secret is not configured")
+			}
+			fmt.Println(server.SignURL(args[0], args[1], signTTL).URL)
+			return nil
+		},
+	}
+	cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "管理转换缓存",
+	}
+	cachePruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "按大小和有效期清理缓存",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config.Load(configFile)
+			removed, freed, err := server.OpenTransformCache().Prune()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("removed %d files, %d bytes freed\n", removed, freed)
+			return nil
+		},
+	}
+	cacheStatsCmd = &cobra.Command{
+		Use:   "stats",
+		Short: "显示缓存统计",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config.Load(configFile)
+			stats, err := server.OpenTransformCache().Stats()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("files: %d\nsize: %d\n", stats.Files, stats.Size)
+			if stats.Files > 0 {
+				fmt.Printf("oldest: %s\nnewest: %s\n", stats.Oldest.Format(time.RFC3339), stats.Newest.Format(time.RFC3339))
+			}
+			return nil
+		},
+	}
+	cacheClearCmd = &cobra.Command{
+		Use:   "clear",
+		Short: "清空缓存",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config.Load(configFile)
+			removed, freed, err := server.OpenTransformCache().Clear()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("removed %d files, %d bytes freed\n", removed, freed)
+			return nil
+		},
+	}
 )
 
 func main() {
@@ -30,5 +93,11 @@ func main() {
 }
 
 func init() {
-	cmd.Flags().StringVarP(&configFile, "conf", "c", "./config.yml", "配置文件")
+	cmd.PersistentFlags().StringVarP(&configFile, "conf", "c", "./config.yml", "配置文件")
+
+	signCmd.Flags().DurationVar(&signTTL, "ttl", 0, "有效期，0 表示永不过期")
+	cmd.AddCommand(signCmd)
+
+	cacheCmd.AddCommand(cachePruneCmd, cacheStatsCmd, cacheClearCmd)
+	cmd.AddCommand(cacheCmd)
 }
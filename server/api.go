@@ -17,8 +17,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
-	"github.com/gabriel-vasile/mimetype"
 	"github.com/labstack/echo/v4"
 )
 
@@ -32,6 +32,15 @@ type HTTPFileInfo struct {
 	Size     int64  `json:"size"`
 	ModTime  int64  `json:"mtime"`
 
+	// dimensions and duration of images, videos and audios, only returned with the media query
+	Media *MediaInfo `json:"media,omitempty"`
+
+	// exif or video capture time, only returned in timelines
+	CaptureTime int64 `json:"captureTime,omitempty"`
+
+	// matched content of full text search
+	Snippets []string `json:"snippets,omitempty"`
+
 	//we return frontend config with
 	Frontend *config.Frontend `json:"frontend"`
 
@@ -57,21 +66,51 @@ func (s *Server) ReadFile(e echo.Context) error {
 		return err
 	}
 
+	if _, ok := params["watch"]; ok && fi.IsDir() {
+		return s.Watch(e, pathParam)
+	}
+
+	if _, ok := params["meta"]; ok && !fi.IsDir() {
+		return s.Meta(e, path, fi)
+	}
+
+	if _, ok := params["hls"]; ok && !fi.IsDir() {
+		return s.HLS(e, path, fi)
+	}
+
+	if _, ok := params["timeline"]; ok && fi.IsDir() {
+		return s.Timeline(e, path, fi)
+	}
+
+	if _, ok := params["geo"]; ok && fi.IsDir() {
+		return s.Geo(e, path)
+	}
+
+	if _, ok := params["search"]; ok && fi.IsDir() {
+		return s.Search(e, path, fi)
+	}
+
+	if _, ok := params["grep"]; ok && fi.IsDir() {
+		return s.Grep(e, path, fi)
+	}
+
 	if isGetInfo {
+		_, withMedia := params["media"]
 		info := s.convertFileInfo(path, fi)
+		if withMedia {
+			s.fillMedia(info, path)
+		}
 		if fi.IsDir() {
 			files, err := os.ReadDir(path)
 			if err != nil {
 				return err
 			}
 
-			for _, f := range files {
-				subPath := filepath.Join(path, f.Name())
-				subFi, err := f.Info()
-				if err != nil {
-					return err
-				}
-				subInfo := s.convertFileInfo(subPath, subFi)
+			subInfos, err := s.convertDirEntries(path, files, withMedia)
+			if err != nil {
+				return err
+			}
+			for _, subInfo := range subInfos {
 				if subInfo.IsDir {
 					if subInfo.Path != s.cacheDir { //skip cache dir
 						info.Dirs = append(info.Dirs, subInfo)
@@ -103,11 +142,28 @@ func (s *Server) WriteFile(e echo.Context) error {
 	pathParam, _ := url.QueryUnescape(e.Param("*"))
 	fpath := s.getFilePath(pathParam)
 
+	if _, ok := e.QueryParams()["sign"]; ok {
+		return s.Sign(e, fpath)
+	}
+
 	// Create dir if not exists
 	if _, err := os.Stat(fpath); os.IsNotExist(err) {
-		if err := os.MkdirAll(fpath, os.ModePerm); err != nil {
+		// the watcher reports the topmost created dir only, so do we
+		top := fpath
+		for {
+			parent := filepath.Dir(top)
+			if _, err := os.Stat(parent); !os.IsNotExist(err) || parent == top {
+				break
+			}
+			top = parent
+		}
+		release := s.hold(getRelSlashPath(top))
+		err := os.MkdirAll(fpath, os.ModePerm)
+		release()
+		if err != nil {
 			return e.String(http.StatusInternalServerError, "Error creating directory: "+err.Error())
 		}
+		s.publish(Event{Type: EventCreated, Path: getRelSlashPath(top), IsDir: true})
 	}
 
 	file, _ := e.FormFile("file")
@@ -131,6 +187,10 @@ func (s *Server) WriteFile(e echo.Context) error {
 	}
 
 	dstPath := filepath.Join(fpath, fname)
+	// the upload is published once it is renamed to its hashed name, the
+	// events the watcher sees for both names in the meantime are skipped
+	release := s.hold(getRelSlashPath(dstPath))
+	defer release()
 	dstFile, err := os.Create(dstPath)
 	if err != nil {
 		return e.String(http.StatusInternalServerError, "Error")
@@ -153,7 +213,11 @@ func (s *Server) WriteFile(e echo.Context) error {
 	hash := hex.EncodeToString(hasher.Sum(nil))
 	hashFileName := setHashFileName(fname, hash)
 
-	os.Rename(dstPath, filepath.Join(fpath, hashFileName))
+	hashPath := filepath.Join(fpath, hashFileName)
+	releaseHash := s.hold(getRelSlashPath(hashPath))
+	defer releaseHash()
+	os.Rename(dstPath, hashPath)
+	s.publish(Event{Type: EventCreated, Path: getRelSlashPath(hashPath)})
 
 	return e.String(http.StatusOK, "Success")
 }
@@ -161,11 +225,22 @@ func (s *Server) WriteFile(e echo.Context) error {
 func (s *Server) DeleteFile(e echo.Context) error {
 	pathParam, _ := url.QueryUnescape(e.Param("*"))
 	fpath := s.getFilePath(pathParam)
-	err := os.RemoveAll(fpath)
+	fi, err := os.Stat(fpath)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return e.String(http.StatusOK, "Success")
+		}
 		return err
 	}
 
+	release := s.hold(getRelSlashPath(fpath))
+	err = os.RemoveAll(fpath)
+	release()
+	if err != nil {
+		return err
+	}
+	s.publish(Event{Type: EventDeleted, Path: getRelSlashPath(fpath), IsDir: fi.IsDir()})
+
 	return e.String(http.StatusOK, "Success")
 }
 
@@ -179,6 +254,26 @@ func (s *Server) getFileRelPath(fpath string) string {
 	return p
 }
 
+// relSlashPath returns the slash separated path of fpath relative to root,
+// root itself is "". ok is false if fpath is not below root.
+func relSlashPath(root string, fpath string) (string, bool) {
+	rel, err := filepath.Rel(root, fpath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if rel == "." {
+		return "", true
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// getRelSlashPath returns the slash separated path of fpath relative to
+// config.C.Dir.
+func getRelSlashPath(fpath string) string {
+	rel, _ := relSlashPath(config.C.Dir, fpath)
+	return rel
+}
+
 func (s *Server) convertFileInfo(path string, fi fs.FileInfo) *HTTPFileInfo {
 	info := HTTPFileInfo{
 		Name:     fi.Name(),
@@ -208,21 +303,61 @@ func (s *Server) convertFileInfo(path string, fi fs.FileInfo) *HTTPFileInfo {
 	return &info
 }
 
-func (s *Server) getFileMimeType(path string, mtime int64) string {
-	key := fmt.Sprintf("%s#%d", path, mtime)
-	s.mimeTypeMutex.Lock()
-	defer s.mimeTypeMutex.Unlock()
-
-	if _, ok := s.mimeTypeCache[key]; !ok {
-		if f, err := os.Open(path); err == nil {
-			defer f.Close()
-			if mtype, err := mimetype.DetectReader(f); err == nil {
-				s.mimeTypeCache[key] = mtype.String()
+// convertDirEntries converts the entries of dir with a bounded number of
+// workers, since the mime types and media infos of uncached files are read
+// from disk.
+func (s *Server) convertDirEntries(dir string, files []fs.DirEntry, withMedia bool) ([]*HTTPFileInfo, error) {
+	infos := make([]*HTTPFileInfo, len(files))
+	errs := make([]error, len(files))
+
+	workers := config.C.Mime.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, f := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, f fs.DirEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			fi, err := f.Info()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			subPath := filepath.Join(dir, f.Name())
+			infos[i] = s.convertFileInfo(subPath, fi)
+			if withMedia {
+				s.fillMedia(infos[i], subPath)
 			}
+		}(i, f)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
 		}
 	}
+	return infos, nil
+}
 
-	return s.mimeTypeCache[key]
+func (s *Server) getFileMimeType(path string, mtime int64) string {
+	return s.mimeTypes.Get(path, mtime).MimeType
+}
+
+func (s *Server) fillMedia(info *HTTPFileInfo, path string) {
+	if info.IsDir {
+		return
+	}
+	if media := s.mimeTypes.GetMedia(path, info.ModTime).Media; media != nil && *media != (MediaInfo{}) {
+		info.Media = media
+	}
 }
 
 func checkFileName(fname string) error {
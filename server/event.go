@@ -0,0 +1,214 @@
+package server
+
+import (
+	"mama/log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventCreated  EventType = "created"
+	EventModified EventType = "modified"
+	EventDeleted  EventType = "deleted"
+	EventRenamed  EventType = "renamed"
+
+	eventBufferSize = 64
+
+	// changes found by the watcher within this window after the same path
+	// was changed through the api are not published again
+	recentChangeWindow = 2 * time.Second
+)
+
+// Event is a change of a file under config.C.Dir, paths are slash
+// separated and relative to config.C.Dir.
+type Event struct {
+	Type    EventType `json:"type"`
+	Path    string    `json:"path"`
+	OldPath string    `json:"oldPath,omitempty"`
+	IsDir   bool      `json:"isDir"`
+	Time    int64     `json:"time"`
+}
+
+// EventBus fans out the published events to all subscriptions, a
+// subscription which can't keep up loses events instead of blocking
+// the publisher.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+	log  *log.Log
+}
+
+type Subscription struct {
+	C    chan Event
+	bus  *EventBus
+	once sync.Once
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: map[*Subscription]struct{}{},
+		log:  log.L.WithNewPrefix("event"),
+	}
+}
+
+func (b *EventBus) Subscribe() *Subscription {
+	sub := &Subscription{
+		C:   make(chan Event, eventBufferSize),
+		bus: b,
+	}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+func (b *EventBus) Publish(ev Event) {
+	if ev.Time == 0 {
+		ev.Time = time.Now().Unix()
+	}
+	b.log.Debugf("publish %s %s", ev.Type, ev.Path)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		select {
+		case sub.C <- ev:
+		default:
+			b.log.Warnf("subscription is full, drop %s %s", ev.Type, ev.Path)
+		}
+	}
+}
+
+func (sub *Subscription) Close() {
+	sub.once.Do(func() {
+		sub.bus.mu.Lock()
+		delete(sub.bus.subs, sub)
+		sub.bus.mu.Unlock()
+		close(sub.C)
+	})
+}
+
+// Close closes all subscriptions.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		sub.once.Do(func() { close(sub.C) })
+		delete(b.subs, sub)
+	}
+}
+
+// publish applies a change made through the api and notifies the subscribers.
+func (s *Server) publish(ev Event) {
+	s.touch(ev.Path)
+	if ev.OldPath != "" {
+		s.touch(ev.OldPath)
+	}
+
+	s.applyEvent(ev)
+	s.bus.Publish(ev)
+}
+
+// onWatchEvent handles a change found by the watcher, the changes just
+// made through the api have been published already and are skipped.
+func (s *Server) onWatchEvent(ev Event) {
+	if s.isRecent(ev.Path) || (ev.OldPath != "" && s.isRecent(ev.OldPath)) {
+		return
+	}
+
+	s.applyEvent(ev)
+	s.bus.Publish(ev)
+}
+
+// touch marks rel as changed through the api.
+func (s *Server) touch(rel string) {
+	s.recentMu.Lock()
+	defer s.recentMu.Unlock()
+
+	now := time.Now()
+	for p, t := range s.recent {
+		if now.Sub(t) > recentChangeWindow {
+			delete(s.recent, p)
+		}
+	}
+	s.recent[rel] = now
+}
+
+// hold marks rel as being changed through the api until the returned func
+// is called, the watcher may report the changes at any time in between and
+// within recentChangeWindow after.
+func (s *Server) hold(rel string) func() {
+	s.recentMu.Lock()
+	s.writing[rel]++
+	s.recentMu.Unlock()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			s.recentMu.Lock()
+			if s.writing[rel]--; s.writing[rel] <= 0 {
+				delete(s.writing, rel)
+			}
+			s.recentMu.Unlock()
+			s.touch(rel)
+		})
+	}
+}
+
+// isRecent reports whether rel or one of its parents was changed through the api.
+func (s *Server) isRecent(rel string) bool {
+	s.recentMu.Lock()
+	defer s.recentMu.Unlock()
+
+	for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if s.writing[p] > 0 {
+			return true
+		}
+		if t, ok := s.recent[p]; ok && time.Since(t) <= recentChangeWindow {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) applyEvent(ev Event) {
+	switch ev.Type {
+	case EventCreated, EventModified:
+		s.invalidate(ev.Path)
+		s.updateIndex(s.getFilePath(ev.Path))
+	case EventDeleted:
+		s.invalidate(ev.Path)
+		s.removeIndex(s.getFilePath(ev.Path))
+	case EventRenamed:
+		s.invalidate(ev.OldPath)
+		s.removeIndex(s.getFilePath(ev.OldPath))
+		s.updateIndex(s.getFilePath(ev.Path))
+	}
+}
+
+// invalidate drops the cached mime types, transform results and hls
+// renditions of rel and of all files below it.
+func (s *Server) invalidate(rel string) {
+	rels := map[string]struct{}{rel: {}}
+	for _, entry := range s.index.Entries(rel) {
+		rels[entry.Path] = struct{}{}
+	}
+
+	for r := range rels {
+		s.transform.Invalidate(r)
+		if s.hls != nil {
+			s.hls.Invalidate(getSourceKey(r))
+		}
+	}
+
+	fpath := s.getFilePath(rel)
+	s.mimeTypes.Invalidate(fpath)
+	s.metas.RemoveFunc(func(key string) bool {
+		return strings.HasPrefix(key, fpath+"#") || strings.HasPrefix(key, fpath+"/")
+	})
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHold(t *testing.T) {
+	s := &Server{recent: map[string]time.Time{}, writing: map[string]int{}}
+
+	release := s.hold("a/b")
+	releaseAgain := s.hold("a/b")
+	for _, rel := range []string{"a/b", "a/b/c.jpg"} {
+		if !s.isRecent(rel) {
+			t.Errorf("isRecent(%q) = false while held", rel)
+		}
+	}
+	if s.isRecent("a") || s.isRecent("a/bc") {
+		t.Error("isRecent is true for a path which is not held")
+	}
+
+	release()
+	release()
+	if s.writing["a/b"] != 1 {
+		t.Errorf("writing = %d after release twice, want 1", s.writing["a/b"])
+	}
+	releaseAgain()
+	if _, ok := s.writing["a/b"]; ok {
+		t.Error("a/b is still held after all releases")
+	}
+	if !s.isRecent("a/b/c.jpg") {
+		t.Error("isRecent is false right after release")
+	}
+
+	s.recent["a/b"] = time.Now().Add(-recentChangeWindow - time.Second)
+	if s.isRecent("a/b/c.jpg") {
+		t.Error("isRecent is true after recentChangeWindow")
+	}
+}
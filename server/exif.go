@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+const xmpMaxScanSize = 4 << 20
+
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// ExifSummary is the commonly used subset of the exif tags.
+type ExifSummary struct {
+	Make             string  `json:"make,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	LensMake         string  `json:"lensMake,omitempty"`
+	LensModel        string  `json:"lensModel,omitempty"`
+	ExposureTime     string  `json:"exposureTime,omitempty"`
+	FNumber          float64 `json:"fNumber,omitempty"`
+	ISO              int     `json:"iso,omitempty"`
+	FocalLength      float64 `json:"focalLength,omitempty"`
+	DateTimeOriginal string  `json:"dateTimeOriginal,omitempty"`
+	Orientation      int     `json:"orientation,omitempty"`
+	GPS              *GPS    `json:"gps,omitempty"`
+}
+
+func readExif(path string) (*exif.Exif, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return exif.Decode(f)
+}
+
+// exifTags returns all the decoded tags of x by name.
+func exifTags(x *exif.Exif) json.RawMessage {
+	data, err := json.Marshal(x)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func exifSummary(x *exif.Exif) *ExifSummary {
+	summary := &ExifSummary{
+		Make:      exifString(x, exif.Make),
+		Model:     exifString(x, exif.Model),
+		LensMake:  exifString(x, exif.LensMake),
+		LensModel: exifString(x, exif.LensModel),
+	}
+
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && den != 0 {
+			if num == 1 || num >= den {
+				summary.ExposureTime = fmt.Sprintf("%g", float64(num)/float64(den))
+				if num == 1 {
+					summary.ExposureTime = fmt.Sprintf("1/%d", den)
+				}
+			} else {
+				summary.ExposureTime = fmt.Sprintf("1/%.0f", float64(den)/float64(num))
+			}
+		}
+	}
+	summary.FNumber = exifFloat(x, exif.FNumber)
+	summary.FocalLength = exifFloat(x, exif.FocalLength)
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		summary.ISO, _ = tag.Int(0)
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		summary.Orientation, _ = tag.Int(0)
+	}
+	if t, err := x.DateTime(); err == nil {
+		summary.DateTimeOriginal = t.Format(time.RFC3339)
+	}
+	summary.GPS = exifGPS(x)
+
+	return summary
+}
+
+func exifGPS(x *exif.Exif) *GPS {
+	lat, long, err := x.LatLong()
+	if err != nil || (lat == 0 && long == 0) {
+		return nil
+	}
+
+	gps := &GPS{Latitude: lat, Longitude: long}
+	if alt := exifFloat(x, exif.GPSAltitude); alt != 0 {
+		if tag, err := x.Get(exif.GPSAltitudeRef); err == nil {
+			if ref, err := tag.Int(0); err == nil && ref == 1 {
+				alt = -alt
+			}
+		}
+		gps.Altitude = &alt
+	}
+	return gps
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	v, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimRight([]byte(v), "\x00 "))
+}
+
+func exifFloat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	switch tag.Format() {
+	case tiff.RatVal:
+		num, den, err := tag.Rat2(0)
+		if err != nil || den == 0 {
+			return 0
+		}
+		return float64(num) / float64(den)
+	case tiff.FloatVal:
+		v, _ := tag.Float(0)
+		return v
+	case tiff.IntVal:
+		v, _ := tag.Int(0)
+		return float64(v)
+	}
+	return 0
+}
+
+// captureMeta returns the exif DateTimeOriginal and location of images or
+// the creation time of videos, the time is 0 if unknown.
+func captureMeta(path string, mimeType string) (int64, *GPS) {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		x, err := readExif(path)
+		if err != nil {
+			return 0, nil
+		}
+		var unix int64
+		if t, err := x.DateTime(); err == nil {
+			unix = t.Unix()
+		}
+		return unix, exifGPS(x)
+	case strings.HasPrefix(mimeType, "video/"):
+		if result, _, err := probe(path); err == nil {
+			if t, err := time.Parse(time.RFC3339Nano, result.Format.Tags["creation_time"]); err == nil {
+				return t.Unix(), nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// readXMP returns the xmp packet embedded in the head of the file.
+func readXMP(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, xmpMaxScanSize))
+	if err != nil {
+		return ""
+	}
+
+	start := bytes.Index(data, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return ""
+	}
+	end := bytes.Index(data[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return ""
+	}
+	return string(data[start : start+end+len("</x:xmpmeta>")])
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errQueueTimeout = errors.New("transform queue is full, try again later")
+
+// transformFlight is a running task shared by the requests of the same key,
+// it is canceled once all the requests are gone.
+type transformFlight struct {
+	done   chan struct{}
+	err    error
+	refs   int
+	cancel context.CancelFunc
+}
+
+// execute runs task in the worker pool and saves the result to the cache,
+// or waits for the running task of the same key.
+func (t *Transform) execute(task *TransformTask) error {
+	t.flightsMu.Lock()
+	f, ok := t.flights[task.key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		f = &transformFlight{done: make(chan struct{}), cancel: cancel}
+		t.flights[task.key] = f
+		go t.fly(ctx, f, task)
+	} else {
+		task.log.Infof("wait for the running task %s", task.key)
+	}
+	f.refs++
+	t.flightsMu.Unlock()
+
+	reqCtx := task.ctx.Request().Context()
+	select {
+	case <-f.done:
+		return f.err
+	case <-reqCtx.Done():
+		t.flightsMu.Lock()
+		f.refs--
+		if f.refs == 0 {
+			// the next request of the key starts a new flight instead of
+			// joining the canceled one
+			f.cancel()
+			if t.flights[task.key] == f {
+				delete(t.flights, task.key)
+			}
+		}
+		t.flightsMu.Unlock()
+		return reqCtx.Err()
+	}
+}
+
+// fly must not use the echo context of task, which is reused once the
+// request that started the flight is gone.
+func (t *Transform) fly(ctx context.Context, f *transformFlight, task *TransformTask) {
+	defer func() {
+		t.flightsMu.Lock()
+		if t.flights[task.key] == f {
+			delete(t.flights, task.key)
+		}
+		t.flightsMu.Unlock()
+		f.cancel()
+		close(f.done)
+	}()
+
+	// wait forever if there is no timeout
+	var timeout <-chan time.Time
+	if t.queueTimeout > 0 {
+		timer := time.NewTimer(t.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case t.workers <- struct{}{}:
+		defer func() { <-t.workers }()
+	case <-timeout:
+		f.err = errQueueTimeout
+		return
+	case <-ctx.Done():
+		f.err = ctx.Err()
+		return
+	}
+
+	if f.err = t.runTask(ctx, task); f.err != nil {
+		return
+	}
+	if f.err = ctx.Err(); f.err != nil {
+		// a new flight of the key may be saving already
+		return
+	}
+	if task.keepMeta {
+		copyMeta(task)
+	}
+	f.err = t.saveCache(task)
+}
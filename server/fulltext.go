@@ -0,0 +1,366 @@
+package server
+
+import (
+	"encoding/json"
+	"html"
+	"mama/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	fullTextFileName = "fulltext.json"
+
+	snippetRadius = 60
+	snippetMax    = 3
+)
+
+var textFileExts = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".rst": true, ".log": true,
+	".json": true, ".csv": true, ".tsv": true, ".xml": true, ".yaml": true, ".yml": true, ".toml": true, ".ini": true,
+	".html": true, ".htm": true, ".css": true, ".js": true, ".jsx": true, ".ts": true, ".tsx": true,
+	".go": true, ".py": true, ".java": true, ".kt": true, ".c": true, ".h": true, ".cpp": true, ".hpp": true,
+	".cs": true, ".rs": true, ".rb": true, ".php": true, ".swift": true, ".sh": true, ".sql": true, ".lua": true,
+}
+
+type fullTextDoc struct {
+	Size    int64    `json:"size"`
+	ModTime int64    `json:"mtime"`
+	Tokens  []string `json:"tokens"`
+}
+
+// FullText is an inverted index of the content of text-like files, the
+// documents are persisted in the cache dir and the postings are rebuilt
+// on load.
+type FullText struct {
+	root        string
+	file        string
+	maxFileSize int64
+	log         *log.Log
+
+	mu       sync.RWMutex
+	docs     map[string]*fullTextDoc
+	postings map[string]map[string]struct{}
+	dirty    bool
+}
+
+func NewFullText(root string, cacheDir string, maxFileSize int64) *FullText {
+	return &FullText{
+		root:        root,
+		file:        filepath.Join(root, cacheDir, fullTextFileName),
+		maxFileSize: maxFileSize,
+		log:         log.L.WithNewPrefix("fulltext"),
+		docs:        map[string]*fullTextDoc{},
+		postings:    map[string]map[string]struct{}{},
+	}
+}
+
+func (ft *FullText) Load() error {
+	data, err := os.ReadFile(ft.file)
+	if err != nil {
+		return err
+	}
+
+	docs := map[string]*fullTextDoc{}
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return err
+	}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.docs = map[string]*fullTextDoc{}
+	ft.postings = map[string]map[string]struct{}{}
+	for rel, doc := range docs {
+		ft.add(rel, doc)
+	}
+	return nil
+}
+
+// Save writes the index if it changed, the changes made while it is written
+// are saved next time.
+func (ft *FullText) Save() error {
+	ft.mu.Lock()
+	if !ft.dirty {
+		ft.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(ft.docs)
+	if err == nil {
+		ft.dirty = false
+	}
+	ft.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := ft.file + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, ft.file)
+	}
+	if err != nil {
+		ft.mu.Lock()
+		ft.dirty = true
+		ft.mu.Unlock()
+	}
+	return err
+}
+
+// Sync indexes the changed text files of entries and drops the documents
+// which are no longer present.
+func (ft *FullText) Sync(entries []*IndexEntry) {
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if !ft.isText(entry) {
+			continue
+		}
+		seen[entry.Path] = true
+		ft.update(entry)
+	}
+
+	ft.mu.Lock()
+	for rel := range ft.docs {
+		if !seen[rel] {
+			ft.remove(rel)
+		}
+	}
+	ft.mu.Unlock()
+}
+
+func (ft *FullText) Update(entry *IndexEntry) {
+	if ft.isText(entry) {
+		ft.update(entry)
+	}
+}
+
+// Remove drops the document of rel and all documents below it.
+func (ft *FullText) Remove(rel string) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	for docRel := range ft.docs {
+		if docRel == rel || isSubPath(rel, docRel) {
+			ft.remove(docRel)
+		}
+	}
+}
+
+// Search returns the documents below dir containing all the words of query.
+func (ft *FullText) Search(dir string, query string, limit int) []string {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	ft.mu.RLock()
+	defer ft.mu.RUnlock()
+
+	sort.Slice(tokens, func(i int, j int) bool {
+		return len(ft.postings[tokens[i]]) < len(ft.postings[tokens[j]])
+	})
+
+	result := []string{}
+	for rel := range ft.postings[tokens[0]] {
+		if dir != "" && !isSubPath(dir, rel) {
+			continue
+		}
+		matched := true
+		for _, token := range tokens[1:] {
+			if _, ok := ft.postings[token][rel]; !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result = append(result, rel)
+		}
+	}
+
+	sort.Strings(result)
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+func (ft *FullText) isText(entry *IndexEntry) bool {
+	if entry.IsDir || entry.Size > ft.maxFileSize {
+		return false
+	}
+	return textFileExts[strings.ToLower(filepath.Ext(entry.Name))] || strings.HasPrefix(entry.MimeType, "text/")
+}
+
+func (ft *FullText) update(entry *IndexEntry) {
+	ft.mu.RLock()
+	old, ok := ft.docs[entry.Path]
+	ft.mu.RUnlock()
+	if ok && old.Size == entry.Size && old.ModTime == entry.ModTime {
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(ft.root, filepath.FromSlash(entry.Path)))
+	if err != nil {
+		ft.log.Warnf("read %s fail: %v", entry.Path, err)
+		return
+	}
+
+	doc := &fullTextDoc{
+		Size:    entry.Size,
+		ModTime: entry.ModTime,
+		Tokens:  tokenize(string(data)),
+	}
+
+	ft.mu.Lock()
+	ft.remove(entry.Path)
+	ft.add(entry.Path, doc)
+	ft.mu.Unlock()
+}
+
+func (ft *FullText) add(rel string, doc *fullTextDoc) {
+	ft.docs[rel] = doc
+	for _, token := range doc.Tokens {
+		if ft.postings[token] == nil {
+			ft.postings[token] = map[string]struct{}{}
+		}
+		ft.postings[token][rel] = struct{}{}
+	}
+	ft.dirty = true
+}
+
+func (ft *FullText) remove(rel string) {
+	doc, ok := ft.docs[rel]
+	if !ok {
+		return
+	}
+	for _, token := range doc.Tokens {
+		delete(ft.postings[token], rel)
+		if len(ft.postings[token]) == 0 {
+			delete(ft.postings, token)
+		}
+	}
+	delete(ft.docs, rel)
+	ft.dirty = true
+}
+
+// tokenize returns the distinct lower case words of text, han characters
+// are indexed one by one since they are not separated by spaces.
+func tokenize(text string) []string {
+	seen := map[string]struct{}{}
+	word := strings.Builder{}
+	flush := func() {
+		if word.Len() > 0 {
+			seen[word.String()] = struct{}{}
+			word.Reset()
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			seen[string(r)] = struct{}{}
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	tokens := make([]string, 0, len(seen))
+	for token := range seen {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// highlight returns up to snippetMax html escaped snippets of text around
+// the words of query, with the words wrapped in <mark>.
+func highlight(text string, query string) []string {
+	lower, offsets := lowerOffsets(text)
+
+	type span struct{ start, end int }
+	spans := []span{}
+	for _, word := range tokenize(query) {
+		for offset := 0; offset < len(lower); {
+			i := strings.Index(lower[offset:], word)
+			if i < 0 {
+				break
+			}
+			// the spans are in text, which may differ in length from lower
+			spans = append(spans, span{offsets[offset+i], offsets[offset+i+len(word)]})
+			offset += i + len(word)
+		}
+	}
+	sort.Slice(spans, func(i int, j int) bool { return spans[i].start < spans[j].start })
+	// han tokens are single runes, adjacent matches are marked as one
+	merged := spans[:0]
+	for _, sp := range spans {
+		if n := len(merged); n > 0 && sp.start <= merged[n-1].end {
+			merged[n-1].end = max(merged[n-1].end, sp.end)
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	spans = merged
+
+	snippets := []string{}
+	for i := 0; i < len(spans) && len(snippets) < snippetMax; {
+		start := runeStart(text, spans[i].start-snippetRadius)
+		end := runeStart(text, spans[i].end+snippetRadius)
+
+		b := strings.Builder{}
+		if start > 0 {
+			b.WriteString("…")
+		}
+		pos := start
+		for ; i < len(spans) && spans[i].start < end; i++ {
+			b.WriteString(html.EscapeString(text[pos:spans[i].start]))
+			b.WriteString("<mark>" + html.EscapeString(text[spans[i].start:spans[i].end]) + "</mark>")
+			pos = spans[i].end
+		}
+		if pos < end {
+			b.WriteString(html.EscapeString(text[pos:end]))
+		}
+		if end < len(text) {
+			b.WriteString("…")
+		}
+		snippets = append(snippets, strings.Join(strings.Fields(b.String()), " "))
+	}
+
+	return snippets
+}
+
+// lowerOffsets lowers text rune by rune like tokenize, the offsets map each
+// byte of the result and its end back to the offsets of text.
+func lowerOffsets(text string) (string, []int) {
+	b := strings.Builder{}
+	offsets := make([]int, 0, len(text)+1)
+	for i, r := range text {
+		n := b.Len()
+		b.WriteRune(unicode.ToLower(r))
+		for ; n < b.Len(); n++ {
+			offsets = append(offsets, i)
+		}
+	}
+	offsets = append(offsets, len(text))
+	return b.String(), offsets
+}
+
+func runeStart(text string, i int) int {
+	if i <= 0 {
+		return 0
+	}
+	if i >= len(text) {
+		return len(text)
+	}
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	return i
+}
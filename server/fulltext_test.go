@@ -0,0 +1,50 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", []string{}},
+		{"Hello, hello World!", []string{"hello", "world"}},
+		{"go1.22 release-notes", []string{"22", "go1", "notes", "release"}},
+		{"İstanbul ÇAY", []string{"istanbul", "çay"}},
+		{"全文搜索 test", []string{"test", "全", "搜", "文", "索"}},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	long := strings.Repeat("a ", 100) + "needle" + strings.Repeat(" b", 100)
+	tests := []struct {
+		text  string
+		query string
+		want  []string
+	}{
+		{"no match here", "needle", []string{}},
+		{"Hello World", "world", []string{"Hello <mark>World</mark>"}},
+		{"İstanbul is big", "istanbul", []string{"<mark>İstanbul</mark> is big"}},
+		{"Visit İstanbul and ANKARA", "ankara", []string{"Visit İstanbul and <mark>ANKARA</mark>"}},
+		{"a <b> & c", "b", []string{"a &lt;<mark>b</mark>&gt; &amp; c"}},
+		{"one two one", "one two", []string{"<mark>one</mark> <mark>two</mark> <mark>one</mark>"}},
+		{"Hello World", "hello,world", []string{"<mark>Hello</mark> <mark>World</mark>"}},
+		{"abcabc", "abc bca", []string{"<mark>abcabc</mark>"}},
+		{"全文搜索引擎", "搜索", []string{"全文<mark>搜索</mark>引擎"}},
+		{long, "needle", []string{"…" + strings.Repeat("a ", 30) + "<mark>needle</mark>" + strings.Repeat(" b", 30) + "…"}},
+	}
+	for _, tt := range tests {
+		if got := highlight(tt.text, tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("highlight(%q, %q) = %q, want %q", tt.text, tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	geoTileSize      = 256
+	geoClusterRadius = 60 // in pixels of the requested zoom level
+	geoMaxZoom       = 22
+)
+
+var errBadBBox = errors.New("bbox should be minLon,minLat,maxLon,maxLat")
+
+type GeoJSON struct {
+	Type     string        `json:"type"`
+	BBox     []float64     `json:"bbox,omitempty"`
+	Features []*GeoFeature `json:"features"`
+}
+
+type GeoFeature struct {
+	Type       string         `json:"type"`
+	Geometry   GeoGeometry    `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type GeoGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type geoBBox struct {
+	minLon, minLat, maxLon, maxLat float64
+}
+
+type geoCluster struct {
+	lon, lat float64
+	entries  []*IndexEntry
+}
+
+// Geo returns the geotagged photos below path as a GeoJSON feature
+// collection. The photos can be limited with bbox=minLon,minLat,maxLon,maxLat
+// and are clustered on a pixel grid if zoom is given. Photos whose location
+// is stripped by the exif policy are left out.
+func (s *Server) Geo(e echo.Context, path string) error {
+	dir, ok := s.index.rel(path)
+	if !ok {
+		return e.String(http.StatusNotFound, "file not found")
+	}
+
+	var bbox *geoBBox
+	if v := e.QueryParam("bbox"); v != "" {
+		var err error
+		if bbox, err = parseBBox(v); err != nil {
+			return e.String(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	zoom := -1
+	if v := e.QueryParam("zoom"); v != "" {
+		z, err := strconv.Atoi(v)
+		if err != nil || z < 0 || z > geoMaxZoom {
+			return e.String(http.StatusBadRequest, "zoom should be 0-22")
+		}
+		zoom = z
+	}
+
+	entries := []*IndexEntry{}
+	for _, entry := range s.index.Entries(dir) {
+		if entry.GPS == nil || (bbox != nil && !bbox.contains(entry.GPS)) {
+			continue
+		}
+		if stripModeOf(entry.Path, "") != StripNone {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i int, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	result := GeoJSON{
+		Type:     "FeatureCollection",
+		Features: []*GeoFeature{},
+	}
+	if bbox != nil {
+		result.BBox = []float64{bbox.minLon, bbox.minLat, bbox.maxLon, bbox.maxLat}
+	}
+
+	if zoom < 0 {
+		for _, entry := range entries {
+			result.Features = append(result.Features, geoPointFeature(entry))
+		}
+		return e.JSON(http.StatusOK, &result)
+	}
+
+	clusters := map[[2]int]*geoCluster{}
+	keys := [][2]int{}
+	for _, entry := range entries {
+		x, y := geoPixel(entry.GPS, zoom)
+		key := [2]int{int(x / geoClusterRadius), int(y / geoClusterRadius)}
+		c, ok := clusters[key]
+		if !ok {
+			c = &geoCluster{}
+			clusters[key] = c
+			keys = append(keys, key)
+		}
+		c.lon += entry.GPS.Longitude
+		c.lat += entry.GPS.Latitude
+		c.entries = append(c.entries, entry)
+	}
+
+	for _, key := range keys {
+		c := clusters[key]
+		if len(c.entries) == 1 {
+			result.Features = append(result.Features, geoPointFeature(c.entries[0]))
+			continue
+		}
+		n := float64(len(c.entries))
+		result.Features = append(result.Features, &GeoFeature{
+			Type: "Feature",
+			Geometry: GeoGeometry{
+				Type:        "Point",
+				Coordinates: []float64{c.lon / n, c.lat / n},
+			},
+			Properties: map[string]any{
+				"cluster": true,
+				"count":   len(c.entries),
+				// the first photo can be used as the cover of the cluster
+				"path": c.entries[0].Path,
+			},
+		})
+	}
+
+	return e.JSON(http.StatusOK, &result)
+}
+
+func geoPointFeature(entry *IndexEntry) *GeoFeature {
+	properties := map[string]any{
+		"path":     entry.Path,
+		"name":     getHashFileName(entry.Name),
+		"mimeType": entry.MimeType,
+	}
+	if entry.CaptureTime != 0 {
+		properties["captureTime"] = entry.CaptureTime
+	}
+	if entry.GPS.Altitude != nil {
+		properties["altitude"] = *entry.GPS.Altitude
+	}
+
+	return &GeoFeature{
+		Type: "Feature",
+		Geometry: GeoGeometry{
+			Type:        "Point",
+			Coordinates: []float64{entry.GPS.Longitude, entry.GPS.Latitude},
+		},
+		Properties: properties,
+	}
+}
+
+// geoPixel projects gps to the web mercator pixel coordinates at zoom.
+func geoPixel(gps *GPS, zoom int) (float64, float64) {
+	size := float64(geoTileSize) * math.Exp2(float64(zoom))
+	lat := math.Max(math.Min(gps.Latitude, 85.05112878), -85.05112878) * math.Pi / 180
+	x := (gps.Longitude + 180) / 360 * size
+	y := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * size
+	return x, y
+}
+
+func parseBBox(v string) (*geoBBox, error) {
+	items := strings.Split(v, ",")
+	if len(items) != 4 {
+		return nil, errBadBBox
+	}
+
+	values := [4]float64{}
+	for i, item := range items {
+		f, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil {
+			return nil, errBadBBox
+		}
+		values[i] = f
+	}
+
+	bbox := &geoBBox{minLon: values[0], minLat: values[1], maxLon: values[2], maxLat: values[3]}
+	if bbox.minLat > bbox.maxLat {
+		return nil, errBadBBox
+	}
+	return bbox, nil
+}
+
+// contains reports whether gps is in the bbox, a bbox with minLon greater
+// than maxLon crosses the antimeridian.
+func (b *geoBBox) contains(gps *GPS) bool {
+	if gps.Latitude < b.minLat || gps.Latitude > b.maxLat {
+		return false
+	}
+	if b.minLon <= b.maxLon {
+		return gps.Longitude >= b.minLon && gps.Longitude <= b.maxLon
+	}
+	return gps.Longitude >= b.minLon || gps.Longitude <= b.maxLon
+}
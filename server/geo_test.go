@@ -0,0 +1,68 @@
+package server
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseBBox(t *testing.T) {
+	tests := []struct {
+		v     string
+		want  *geoBBox
+		in    [][2]float64
+		notIn [][2]float64
+	}{
+		{"", nil, nil, nil},
+		{"1,2,3", nil, nil, nil},
+		{"a,2,3,4", nil, nil, nil},
+		{"0,10,10,0", nil, nil, nil},
+		{" -10, 40 ,10,50", &geoBBox{-10, 40, 10, 50}, [][2]float64{{45, 0}, {40, -10}}, [][2]float64{{39, 0}, {45, 11}}},
+		// crosses the antimeridian
+		{"170,-10,-170,10", &geoBBox{170, -10, -170, 10}, [][2]float64{{0, 175}, {0, -175}}, [][2]float64{{0, 0}, {20, 175}}},
+	}
+	for _, tt := range tests {
+		got, err := parseBBox(tt.v)
+		if tt.want == nil {
+			if err != errBadBBox {
+				t.Errorf("parseBBox(%q) err = %v, want errBadBBox", tt.v, err)
+			}
+			continue
+		}
+		if err != nil || *got != *tt.want {
+			t.Errorf("parseBBox(%q) = %v, %v, want %v", tt.v, got, err, tt.want)
+			continue
+		}
+		for _, p := range tt.in {
+			if !got.contains(&GPS{Latitude: p[0], Longitude: p[1]}) {
+				t.Errorf("%q does not contain %v", tt.v, p)
+			}
+		}
+		for _, p := range tt.notIn {
+			if got.contains(&GPS{Latitude: p[0], Longitude: p[1]}) {
+				t.Errorf("%q contains %v", tt.v, p)
+			}
+		}
+	}
+}
+
+func TestGeoPixel(t *testing.T) {
+	tests := []struct {
+		gps  GPS
+		zoom int
+		x, y float64
+	}{
+		{GPS{Latitude: 0, Longitude: 0}, 0, 128, 128},
+		{GPS{Latitude: 0, Longitude: -180}, 1, 0, 256},
+		{GPS{Latitude: 0, Longitude: 180}, 2, 1024, 512},
+		{GPS{Latitude: 85.05112878, Longitude: 0}, 0, 128, 0},
+		// clamped to the web mercator bounds
+		{GPS{Latitude: 90, Longitude: 0}, 0, 128, 0},
+		{GPS{Latitude: -90, Longitude: 0}, 0, 128, 256},
+	}
+	for _, tt := range tests {
+		x, y := geoPixel(&tt.gps, tt.zoom)
+		if math.Abs(x-tt.x) > 1e-3 || math.Abs(y-tt.y) > 1e-3 {
+			t.Errorf("geoPixel(%v, %d) = %v, %v, want %v, %v", tt.gps, tt.zoom, x, y, tt.x, tt.y)
+		}
+	}
+}
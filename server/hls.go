@@ -0,0 +1,500 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mama/config"
+	"mama/log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+const (
+	HLS_CACHE_DIR = "hls"
+
+	hlsPlaylist    = "index.m3u8"
+	hlsSegmentName = "seg%d.ts"
+	hlsMimeType    = "application/vnd.apple.mpegurl"
+
+	// how long a request waits for its playlist or segment to be written
+	hlsWaitTimeout  = 30 * time.Second
+	hlsPollInterval = 200 * time.Millisecond
+)
+
+var (
+	errHLSBusy        = errors.New("too many transcodes")
+	hlsSegmentPattern = regexp.MustCompile(`^seg[0-9]+\.ts$`)
+)
+
+// HLS transcodes videos into the configured renditions on demand, each
+// rendition is written to dir/<source key>/<name>-<version>/ by a ffmpeg
+// job which is stopped when it is not requested in idleTimeout.
+type HLS struct {
+	dir  string
+	conf config.HLS
+
+	jobs map[string]*hlsJob
+	mu   sync.Mutex
+}
+
+type hlsJob struct {
+	cancel     context.CancelFunc
+	done       chan struct{}
+	err        error
+	lastAccess atomic.Int64
+}
+
+func NewHLS(dir string, conf config.HLS) *HLS {
+	os.MkdirAll(dir, 0755)
+	conf.MaxJobs = max(1, conf.MaxJobs)
+	return &HLS{
+		dir:  dir,
+		conf: conf,
+		jobs: map[string]*hlsJob{},
+	}
+}
+
+// Run stops the idle jobs and removes the outputs not requested in maxAge,
+// all jobs are stopped when ctx is done.
+func (h *HLS) Run(ctx context.Context) {
+	logger := log.L.WithNewPrefix("hls")
+	interval := min(time.Minute, max(time.Second, h.conf.IdleTimeout/2))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			h.stopAll()
+			return
+		case <-ticker.C:
+		}
+
+		if stopped := h.stopIdle(); stopped > 0 {
+			logger.Infof("stopped %d idle transcodes", stopped)
+		}
+		if removed := h.prune(); removed > 0 {
+			logger.Infof("removed %d expired renditions", removed)
+		}
+	}
+}
+
+// Invalidate stops the jobs of the source with sourceKey and removes their
+// outputs.
+func (h *HLS) Invalidate(sourceKey string) {
+	prefix := filepath.Join(h.dir, sourceKey) + string(filepath.Separator)
+	h.mu.Lock()
+	jobs := []*hlsJob{}
+	for dir, job := range h.jobs {
+		if strings.HasPrefix(dir, prefix) {
+			job.cancel()
+			jobs = append(jobs, job)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, job := range jobs {
+		<-job.done
+	}
+	if err := os.RemoveAll(filepath.Join(h.dir, sourceKey)); err != nil {
+		log.Warnf("remove hls cache of %s fail: %v", sourceKey, err)
+	}
+}
+
+func (h *HLS) rendition(name string) (config.Rendition, bool) {
+	for _, r := range h.conf.Renditions {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return config.Rendition{}, false
+}
+
+// outputDir changes with the source file and the rendition config, so
+// stale outputs are never served.
+func (h *HLS) outputDir(rel string, info fs.FileInfo, r config.Rendition) string {
+	version := md5.Sum([]byte(fmt.Sprintf("%d#%d#%d#%s#%s#%s", info.ModTime().UnixNano(), info.Size(), r.Height, r.VideoBitrate, r.AudioBitrate, h.conf.SegmentDuration)))
+	return filepath.Join(h.dir, getSourceKey(rel), r.Name+"-"+hex.EncodeToString(version[:8]))
+}
+
+// start returns the running job of dir, or starts one if the output of dir
+// is not complete, nil is returned for a complete output.
+func (h *HLS) start(path string, dir string, base string, r config.Rendition) (*hlsJob, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if job, ok := h.jobs[dir]; ok {
+		job.lastAccess.Store(now.UnixNano())
+		return job, nil
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, hlsPlaylist)); err == nil && isPlaylistComplete(data) {
+		os.Chtimes(dir, now, now)
+		return nil, nil
+	}
+	if len(h.jobs) >= h.conf.MaxJobs {
+		return nil, errHLSBusy
+	}
+
+	// a stopped job is resumed after the segments it has written
+	start, offset := 0, 0.0
+	if data, err := os.ReadFile(filepath.Join(dir, hlsPlaylist)); err == nil {
+		start, offset = parsePlaylist(data)
+	}
+	if start == 0 {
+		os.RemoveAll(dir)
+	} else {
+		removePartialSegments(dir, start)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &hlsJob{cancel: cancel, done: make(chan struct{})}
+	job.lastAccess.Store(now.UnixNano())
+	h.jobs[dir] = job
+
+	go func() {
+		logger := log.L.WithNewPrefix("hls " + filepath.Base(path) + " " + r.Name)
+		logger.Infof("start transcoding from segment %d at %gs", start, offset)
+		begin := time.Now()
+		err := h.transcode(ctx, path, dir, base, r, start, offset)
+		if err != nil && ctx.Err() == nil {
+			logger.Warnf("transcode fail: %v", err)
+			os.RemoveAll(dir)
+			os.Remove(filepath.Dir(dir))
+		} else if err == nil {
+			logger.Infof("transcoded in %s", time.Since(begin))
+		}
+
+		h.mu.Lock()
+		delete(h.jobs, dir)
+		h.mu.Unlock()
+		job.err = err
+		close(job.done)
+		cancel()
+	}()
+	return job, nil
+}
+
+// transcode writes the segments from the start-th one, which begins at
+// offset seconds of the video.
+func (h *HLS) transcode(ctx context.Context, path string, dir string, base string, r config.Rendition, start int, offset float64) error {
+	segment := h.conf.SegmentDuration.Seconds()
+	if segment <= 0 {
+		segment = 6
+	}
+
+	kwargs := ffmpeg.KwArgs{
+		// never upscale, the height is kept even for yuv420p
+		"vf":               fmt.Sprintf("scale=-2:'min(%d,trunc(ih/2)*2)'", r.Height),
+		"c:v":              "libx264",
+		"preset":           "veryfast",
+		"pix_fmt":          "yuv420p",
+		"sc_threshold":     0,
+		"force_key_frames": fmt.Sprintf("expr:gte(t,n_forced*%g)", segment),
+		"c:a":              "aac",
+		"ac":               2,
+		"loglevel":         "error",
+
+		"f":                    "hls",
+		"hls_time":             segment,
+		"hls_playlist_type":    "event",
+		"hls_segment_filename": filepath.Join(dir, hlsSegmentName),
+		"hls_base_url":         base + "?hls=" + url.QueryEscape(r.Name) + "&seg=",
+	}
+	if r.VideoBitrate != "" {
+		kwargs["b:v"] = r.VideoBitrate
+		kwargs["maxrate"] = r.VideoBitrate
+		kwargs["bufsize"] = r.VideoBitrate
+	}
+	if r.AudioBitrate != "" {
+		kwargs["b:a"] = r.AudioBitrate
+	}
+
+	input := ffmpeg.KwArgs{}
+	if start > 0 {
+		input["ss"] = strconv.FormatFloat(offset, 'f', 3, 64)
+		// the timestamps continue from the written segments
+		kwargs["output_ts_offset"] = input["ss"]
+		kwargs["start_number"] = start
+		kwargs["hls_flags"] = "append_list"
+	}
+
+	stderr := bytes.NewBuffer(nil)
+	stream := ffmpeg.Input(path, input).Output(filepath.Join(dir, hlsPlaylist), kwargs)
+	stream.Context = ctx
+	if err := stream.OverWriteOutput().WithErrorOutput(stderr).Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *HLS) stopIdle() int {
+	if h.conf.IdleTimeout <= 0 {
+		return 0
+	}
+	expire := time.Now().Add(-h.conf.IdleTimeout).UnixNano()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stopped := 0
+	for _, job := range h.jobs {
+		if job.lastAccess.Load() < expire {
+			job.cancel()
+			stopped++
+		}
+	}
+	return stopped
+}
+
+func (h *HLS) stopAll() {
+	h.mu.Lock()
+	jobs := []*hlsJob{}
+	for _, job := range h.jobs {
+		job.cancel()
+		jobs = append(jobs, job)
+	}
+	h.mu.Unlock()
+
+	for _, job := range jobs {
+		<-job.done
+	}
+}
+
+// prune removes the renditions not requested in maxAge, the mtime of a
+// rendition dir is its access time.
+func (h *HLS) prune() int {
+	if h.conf.MaxAge <= 0 {
+		return 0
+	}
+	expire := time.Now().Add(-h.conf.MaxAge)
+	dirs, _ := filepath.Glob(filepath.Join(h.dir, "*", "*"))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	removed := 0
+	for _, dir := range dirs {
+		if _, ok := h.jobs[dir]; ok {
+			continue
+		}
+		info, err := os.Stat(dir)
+		if err != nil || info.ModTime().After(expire) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("remove hls cache %s fail: %v", dir, err)
+			continue
+		}
+		removed++
+		// the source dir is only removed when it is empty
+		os.Remove(filepath.Dir(dir))
+	}
+	return removed
+}
+
+func isPlaylistComplete(data []byte) bool {
+	return bytes.Contains(data, []byte("#EXT-X-ENDLIST"))
+}
+
+// parsePlaylist returns the number and the total duration of the segments
+// in a media playlist.
+func parsePlaylist(data []byte) (int, float64) {
+	count, duration := 0, 0.0
+	for _, line := range strings.Split(string(data), "\n") {
+		v, ok := strings.CutPrefix(strings.TrimSpace(line), "#EXTINF:")
+		if !ok {
+			continue
+		}
+		v, _, _ = strings.Cut(v, ",")
+		d, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			break
+		}
+		count++
+		duration += d
+	}
+	return count, duration
+}
+
+// removePartialSegments removes the segments from the start-th one, which
+// are not in the playlist yet.
+func removePartialSegments(dir string, start int) {
+	files, _ := filepath.Glob(filepath.Join(dir, "seg*.ts"))
+	for _, f := range files {
+		var n int
+		if _, err := fmt.Sscanf(filepath.Base(f), hlsSegmentName, &n); err == nil && n >= start {
+			os.Remove(f)
+		}
+	}
+}
+
+// HLS serves the master playlist of a video for ?hls, the media playlist of
+// a rendition for ?hls=<name> and its segments for ?hls=<name>&seg=<file>.
+func (s *Server) HLS(e echo.Context, path string, fi fs.FileInfo) error {
+	if s.hls == nil {
+		return e.String(http.StatusNotFound, "hls is disabled")
+	}
+	// only videos are fed to ffmpeg
+	meta := s.mimeTypes.GetMedia(path, fi.ModTime().Unix())
+	info := meta.Media
+	if !strings.HasPrefix(meta.MimeType, "video/") || info == nil || info.Width <= 0 || info.Height <= 0 {
+		return e.String(http.StatusUnsupportedMediaType, "not a video")
+	}
+
+	name := e.QueryParam("hls")
+	if name == "" {
+		return s.hlsMaster(e, path, info)
+	}
+
+	r, ok := s.hls.rendition(name)
+	if !ok {
+		return e.String(http.StatusNotFound, "rendition not found")
+	}
+	seg := e.QueryParam("seg")
+	if seg != "" && !hlsSegmentPattern.MatchString(seg) {
+		return e.String(http.StatusBadRequest, "invalid segment")
+	}
+
+	dir := s.hls.outputDir(getRelSlashPath(path), fi, r)
+	job, err := s.hls.start(path, dir, url.PathEscape(fi.Name()), r)
+	if errors.Is(err, errHLSBusy) {
+		e.Response().Header().Set("Retry-After", "5")
+		return e.String(http.StatusServiceUnavailable, err.Error())
+	} else if err != nil {
+		return err
+	}
+
+	ready := func(playlist []byte) bool {
+		if seg == "" {
+			return bytes.Contains(playlist, []byte("#EXTINF"))
+		}
+		return bytes.Contains(playlist, []byte("seg="+seg+"\n")) || isPlaylistComplete(playlist)
+	}
+
+	ctx := e.Request().Context()
+	timeout := time.NewTimer(hlsWaitTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(hlsPollInterval)
+	defer ticker.Stop()
+
+	var playlist []byte
+	for {
+		playlist, _ = os.ReadFile(filepath.Join(dir, hlsPlaylist))
+		if ready(playlist) {
+			break
+		}
+		if job == nil {
+			return e.String(http.StatusNotFound, "segment not found")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timeout.C:
+			e.Response().Header().Set("Retry-After", "1")
+			return e.String(http.StatusServiceUnavailable, "transcoding")
+		case <-job.done:
+			if job.err != nil {
+				return e.String(http.StatusInternalServerError, "transcode fail")
+			}
+			job = nil
+		case <-ticker.C:
+			// the job is not idle while requests are waiting for it
+			job.lastAccess.Store(time.Now().UnixNano())
+		}
+	}
+
+	if seg == "" {
+		if !isPlaylistComplete(playlist) {
+			e.Response().Header().Set("Cache-Control", "no-cache")
+		}
+		return e.Blob(http.StatusOK, hlsMimeType, playlist)
+	}
+
+	f, err := os.Open(filepath.Join(dir, seg))
+	if err != nil {
+		return e.String(http.StatusNotFound, "segment not found")
+	}
+	defer f.Close()
+	segInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	e.Response().Header().Set(echo.HeaderContentType, "video/mp2t")
+	http.ServeContent(e.Response(), e.Request(), seg, segInfo.ModTime(), f)
+	return nil
+}
+
+// hlsMaster lists the renditions not higher than the video, or the lowest
+// one for small videos.
+func (s *Server) hlsMaster(e echo.Context, path string, info *MediaInfo) error {
+	renditions := []config.Rendition{}
+	var lowest *config.Rendition
+	for i, r := range s.hls.conf.Renditions {
+		if r.Height <= info.Height {
+			renditions = append(renditions, r)
+		}
+		if lowest == nil || r.Height < lowest.Height {
+			lowest = &s.hls.conf.Renditions[i]
+		}
+	}
+	if len(renditions) == 0 && lowest != nil {
+		renditions = append(renditions, *lowest)
+	}
+	if len(renditions) == 0 {
+		return e.String(http.StatusNotFound, "no renditions")
+	}
+
+	base := url.PathEscape(filepath.Base(path))
+	buf := bytes.NewBufferString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range renditions {
+		height := min(r.Height, info.Height)
+		width := int(math.Round(float64(height)*float64(info.Width)/float64(info.Height)/2)) * 2
+		bandwidth := parseBitrate(r.VideoBitrate) + parseBitrate(r.AudioBitrate)
+		fmt.Fprintf(buf, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,NAME=%q\n", bandwidth, width, height, r.Name)
+		fmt.Fprintf(buf, "%s?hls=%s\n", base, url.QueryEscape(r.Name))
+	}
+
+	return e.Blob(http.StatusOK, hlsMimeType, buf.Bytes())
+}
+
+// parseBitrate parses bitrates like 800k or 5M in bits per second.
+func parseBitrate(v string) int {
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(v, "k"), strings.HasSuffix(v, "K"):
+		scale = 1e3
+	case strings.HasSuffix(v, "m"), strings.HasSuffix(v, "M"):
+		scale = 1e6
+	}
+	if scale != 1 {
+		v = v[:len(v)-1]
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0
+	}
+	return int(f * scale)
+}
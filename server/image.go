@@ -2,12 +2,19 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"image"
+	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"mama/config"
 	"math"
+	"strconv"
+	"strings"
 
 	"github.com/nao1215/imaging"
 	"github.com/rwcarlsen/goexif/exif"
@@ -27,6 +34,7 @@ const (
 	TIFF Format = "tiff"
 	BMP  Format = "bmp"
 	WEBP Format = "webp"
+	AVIF Format = "avif"
 )
 
 var (
@@ -38,6 +46,16 @@ var (
 		"tiff": TIFF,
 		"bmp":  BMP,
 		"webp": WEBP,
+		"avif": AVIF,
+	}
+	FormatToMimeType = map[Format]string{
+		JPEG: "image/jpeg",
+		PNG:  "image/png",
+		GIF:  "image/gif",
+		TIFF: "image/tiff",
+		BMP:  "image/bmp",
+		WEBP: "image/webp",
+		AVIF: "image/avif",
 	}
 	MimeTypeToFormat = map[string]Format{
 		"image/bmp":  BMP,
@@ -49,11 +67,57 @@ var (
 	}
 )
 
+// Anchors are the gravity names of crop and cover.
+var Anchors = map[string]imaging.Anchor{
+	"center":      imaging.Center,
+	"top":         imaging.Top,
+	"bottom":      imaging.Bottom,
+	"left":        imaging.Left,
+	"right":       imaging.Right,
+	"topleft":     imaging.TopLeft,
+	"topright":    imaging.TopRight,
+	"bottomleft":  imaging.BottomLeft,
+	"bottomright": imaging.BottomRight,
+}
+
 type (
 	transformation func(img image.Image, width int, height int, filter imaging.ResampleFilter) *image.NRGBA
 )
 
+// ErrImageTooLarge is returned for images over the configured limits.
+var ErrImageTooLarge = errors.New("image too large")
+
+// checkImageLimits checks the size and the dimensions in the header of the
+// image before it is decoded, a small file may claim a huge image.
+func checkImageLimits(reader io.ReadSeeker) error {
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if maxSize := config.C.Transform.MaxInputSize; maxSize > 0 && size > maxSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d bytes", ErrImageTooLarge, size, maxSize)
+	}
+
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return err
+	}
+	if maxPixels := config.C.Transform.MaxMegapixels * 1e6; maxPixels > 0 && float64(cfg.Width)*float64(cfg.Height) > maxPixels {
+		return fmt.Errorf("%w: %dx%d, the limit is %g megapixels", ErrImageTooLarge, cfg.Width, cfg.Height, config.C.Transform.MaxMegapixels)
+	}
+
+	_, err = reader.Seek(0, io.SeekStart)
+	return err
+}
+
 func imageDecode(reader io.ReadSeeker) (image.Image, error) {
+	if err := checkImageLimits(reader); err != nil {
+		return nil, err
+	}
+
 	img, err := imaging.Decode(reader)
 	if err != nil {
 		return nil, err
@@ -104,10 +168,25 @@ func imageOrientation(reader io.Reader) string {
 	return "1"
 }
 
-func imageDecodeBytes(data []byte) (image.Image, error) {
-	return imageDecode(bytes.NewReader(data))
+func imageDecodeBytes(ctx context.Context, data []byte) (image.Image, error) {
+	return imageDecode(&contextReader{ctx: ctx, ReadSeeker: bytes.NewReader(data)})
+}
+
+// contextReader fails the reads once ctx is done, so a long decode stops
+// soon after the request is gone.
+type contextReader struct {
+	ctx context.Context
+	io.ReadSeeker
 }
-func imageEncode(w io.Writer, img image.Image, format Format, quality int) error {
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadSeeker.Read(p)
+}
+
+func imageEncode(w io.Writer, img image.Image, format Format, quality int, lossless bool) error {
 	var err error
 	switch format {
 	case JPEG:
@@ -135,8 +214,10 @@ func imageEncode(w io.Writer, img image.Image, format Format, quality int) error
 		err = tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
 	case BMP:
 		err = bmp.Encode(w, img)
-	// case imagefile.WEBP:
-	// 	err = webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+	case WEBP:
+		err = webpEncode(w, img, quality, lossless)
+	case AVIF:
+		err = avifEncode(w, img, quality, lossless)
 	default:
 		err = imaging.ErrUnsupportedFormat
 	}
@@ -157,10 +238,10 @@ func imageSize(img image.Image) (int, int) {
 	return img.Bounds().Max.X, img.Bounds().Max.Y
 }
 
-func imageToBytes(img image.Image, format Format, quality int) ([]byte, error) {
+func imageToBytes(img image.Image, format Format, quality int, lossless bool) ([]byte, error) {
 	var buf bytes.Buffer
 
-	if err := imageEncode(&buf, img, format, quality); err != nil {
+	if err := imageEncode(&buf, img, format, quality, lossless); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
@@ -175,3 +256,114 @@ func imageScale(img image.Image, width int, height int, trans transformation) im
 
 	return img
 }
+
+// negotiateFormat returns the best format accepted by the accept header,
+// AVIF is preferred over WEBP, which is only offered if it can be lossy.
+// If neither is accepted the source format is kept for png and jpeg, and
+// other formats are converted to png or jpeg.
+func negotiateFormat(accept string, source Format) Format {
+	accepted := map[string]bool{}
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		mtype := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[mtype] = q > 0
+	}
+
+	switch {
+	case accepted[FormatToMimeType[AVIF]] && avifSupported():
+		return AVIF
+	case accepted[FormatToMimeType[WEBP]] && webpLossySupported:
+		return WEBP
+	case source == JPEG || source == PNG:
+		return source
+	case source == GIF || source == WEBP:
+		// may be transparent
+		return PNG
+	default:
+		return JPEG
+	}
+}
+
+// parseColor parses a rgb, rgba, rrggbb or rrggbbaa hex color, with or
+// without the leading #.
+func parseColor(v string) (color.NRGBA, bool) {
+	v = strings.TrimPrefix(strings.ToLower(v), "#")
+	if v == "transparent" {
+		return color.NRGBA{}, true
+	}
+	if len(v) == 3 || len(v) == 4 {
+		expanded := make([]byte, 0, len(v)*2)
+		for i := range v {
+			expanded = append(expanded, v[i], v[i])
+		}
+		v = string(expanded)
+	}
+	if len(v) == 6 {
+		v += "ff"
+	}
+	if len(v) != 8 {
+		return color.NRGBA{}, false
+	}
+	n, err := strconv.ParseUint(v, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, false
+	}
+	return color.NRGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, true
+}
+
+// imageShrinkBox scales the box of width x height down to fit in img and
+// keeps its ratio, a zero side stays zero.
+func imageShrinkBox(img image.Image, width int, height int) (int, int) {
+	w, h := imageSize(img)
+	if width > 0 && height > 0 {
+		factor := math.Min(1, math.Min(float64(w)/float64(width), float64(h)/float64(height)))
+		return max(1, int(math.Round(float64(width)*factor))), max(1, int(math.Round(float64(height)*factor)))
+	}
+	return min(width, w), min(height, h)
+}
+
+// imageRatioSize returns the size of img resized to width or height with
+// its ratio kept.
+func imageRatioSize(img image.Image, width int, height int) (int, int) {
+	w, h := imageSize(img)
+	if width == 0 {
+		return max(1, int(math.Round(float64(w)*float64(height)/float64(h)))), height
+	}
+	if height == 0 {
+		return width, max(1, int(math.Round(float64(h)*float64(width)/float64(w))))
+	}
+	return width, height
+}
+
+// imageContain scales img to fit in width x height keeping the ratio, the
+// rest of the area is filled with bg.
+func imageContain(img image.Image, width int, height int, bg color.Color) image.Image {
+	w, h := imageSize(img)
+	factor := math.Min(float64(width)/float64(w), float64(height)/float64(h))
+	scaled := imaging.Resize(img, max(1, int(math.Round(float64(w)*factor))), max(1, int(math.Round(float64(h)*factor))), imaging.Lanczos)
+	return imaging.PasteCenter(imaging.New(width, height, bg), scaled)
+}
+
+// imageRotate rotates img clockwise by angle degrees, the corners uncovered
+// by an arbitrary angle are filled with bg.
+func imageRotate(img image.Image, angle float64, bg color.Color) image.Image {
+	switch angle {
+	case 0:
+		return img
+	case 90:
+		return imaging.Rotate270(img)
+	case 180:
+		return imaging.Rotate180(img)
+	case 270:
+		return imaging.Rotate90(img)
+	}
+	return imaging.Rotate(img, 360-angle, bg)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// avifEncoders are the av1 encoders of ffmpeg able to encode avif, in the
+// order of preference.
+var avifEncoders = []string{"libaom-av1", "libsvtav1"}
+
+// avifEncoder returns the first av1 encoder listed by the installed ffmpeg,
+// an empty string if there is none.
+var avifEncoder = sync.OnceValue(func() string {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return ""
+	}
+	listed := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		// the lines of encoders are like " V....D libaom-av1  libaom AV1"
+		if fields := strings.Fields(line); len(fields) > 1 {
+			listed[fields[1]] = true
+		}
+	}
+	for _, encoder := range avifEncoders {
+		if listed[encoder] {
+			return encoder
+		}
+	}
+	return ""
+})
+
+func avifSupported() bool {
+	return avifEncoder() != ""
+}
+
+// avifEncode encodes img with the av1 encoder of ffmpeg, the avif muxer
+// needs a seekable output so the result is written to a temp file.
+func avifEncode(w io.Writer, img image.Image, quality int, lossless bool) error {
+	input := bytes.NewBuffer(nil)
+	if err := png.Encode(input, img); err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp("", APP_NAME+"-*.avif")
+	if err != nil {
+		return err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	// crf 0 is lossless, 63 is the worst quality
+	crf := 63 - quality*63/100
+	if lossless || crf < 0 {
+		crf = 0
+	}
+	if crf > 63 {
+		crf = 63
+	}
+
+	encoder := avifEncoder()
+	if encoder == "" {
+		return errors.New("ffmpeg has no av1 encoder")
+	}
+	kwargs := ffmpeg.KwArgs{"c:v": encoder, "crf": crf, "pix_fmt": "yuv420p", "f": "avif"}
+	if encoder == "libaom-av1" {
+		kwargs["still-picture"] = 1
+		kwargs["cpu-used"] = 6
+	} else {
+		kwargs["preset"] = 8
+	}
+
+	stderr := bytes.NewBuffer(nil)
+	err = ffmpeg.Input("pipe:", ffmpeg.KwArgs{"f": "png_pipe"}).
+		Output(out.Name(), kwargs).
+		OverWriteOutput().
+		WithInput(input).
+		WithErrorOutput(stderr).
+		Run()
+	if err != nil {
+		return fmt.Errorf("ffmpeg encode avif fail: %w: %s", err, stderr.String())
+	}
+
+	f, err := os.Open(out.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,37 @@
+package server
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	defer func(f func() string) { avifEncoder = f }(avifEncoder)
+
+	// webp is only offered if it can be lossy
+	webp, transparent := JPEG, PNG
+	if webpLossySupported {
+		webp, transparent = WEBP, WEBP
+	}
+	tests := []struct {
+		accept  string
+		source  Format
+		encoder string
+		want    Format
+	}{
+		{"", JPEG, "", JPEG},
+		{"*/*", PNG, "", PNG},
+		{"image/*", GIF, "", PNG},
+		{"image/webp,*/*", WEBP, "", transparent},
+		{"image/webp,image/*;q=0.8", JPEG, "", webp},
+		{"image/webp;q=0, image/jpeg", JPEG, "", JPEG},
+		{"image/avif,image/webp", JPEG, "", webp},
+		{"image/avif,image/webp", JPEG, "libsvtav1", AVIF},
+		{"IMAGE/AVIF ; q=0.5", PNG, "libaom-av1", AVIF},
+		{"image/avif;q=0", PNG, "libaom-av1", PNG},
+		{"image/avif", BMP, "", JPEG},
+	}
+	for _, tt := range tests {
+		avifEncoder = func() string { return tt.encoder }
+		if got := negotiateFormat(tt.accept, tt.source); got != tt.want {
+			t.Errorf("negotiateFormat(%q, %s) with %q = %s, want %s", tt.accept, tt.source, tt.encoder, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build cgo
+
+package server
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+const webpLossySupported = true
+
+func webpEncode(w io.Writer, img image.Image, quality int, lossless bool) error {
+	return webp.Encode(w, img, &webp.Options{Lossless: lossless, Quality: float32(quality)})
+}
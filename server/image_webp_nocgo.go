@@ -0,0 +1,19 @@
+//go:build !cgo
+
+package server
+
+import (
+	"image"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// the encoder without cgo only supports lossless encoding, which is often
+// larger than jpeg, so lossy webp is neither negotiated nor accepted
+const webpLossySupported = false
+
+// webpEncode without cgo only supports lossless encoding, the quality is ignored.
+func webpEncode(w io.Writer, img image.Image, quality int, lossless bool) error {
+	return nativewebp.Encode(w, img, nil)
+}
@@ -0,0 +1,424 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"mama/log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+const (
+	indexFileName = "index.json"
+	// bump to extract the media metadata of the persisted entries again
+	indexMetaVersion = 2
+
+	matchSubstring = "substring"
+	matchGlob      = "glob"
+	matchRegex     = "regex"
+)
+
+type IndexEntry struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	IsDir    bool   `json:"isDir"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mtime"`
+	MimeType string `json:"mimeType"`
+
+	// capture time of images and videos, 0 if unknown
+	CaptureTime int64 `json:"captureTime,omitempty"`
+	// location of geotagged photos
+	GPS         *GPS `json:"gps,omitempty"`
+	MetaVersion int  `json:"metaVersion,omitempty"`
+}
+
+// Index keeps the metadata of every file under root, it is refreshed
+// incrementally and persisted in the cache dir.
+type Index struct {
+	root string
+	file string
+	skip string
+	log  *log.Log
+
+	mu      sync.RWMutex
+	entries map[string]*IndexEntry
+	dirty   bool
+}
+
+type SearchQuery struct {
+	Dir      string
+	Pattern  string
+	Match    string
+	MimeType string
+	MinSize  int64
+	MaxSize  int64
+	After    int64
+	Before   int64
+	Limit    int
+}
+
+func NewIndex(root string, cacheDir string) *Index {
+	return &Index{
+		root:    root,
+		file:    filepath.Join(root, cacheDir, indexFileName),
+		skip:    cacheDir,
+		log:     log.L.WithNewPrefix("index"),
+		entries: map[string]*IndexEntry{},
+	}
+}
+
+func (idx *Index) Load() error {
+	data, err := os.ReadFile(idx.file)
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]*IndexEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	idx.entries = entries
+	idx.mu.Unlock()
+	return nil
+}
+
+// Save writes the index if it changed, the changes made while it is written
+// are saved next time.
+func (idx *Index) Save() error {
+	idx.mu.Lock()
+	if !idx.dirty {
+		idx.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(idx.entries)
+	if err == nil {
+		idx.dirty = false
+	}
+	idx.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := idx.write(data); err != nil {
+		idx.mu.Lock()
+		idx.dirty = true
+		idx.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (idx *Index) write(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(idx.file), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := idx.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.file)
+}
+
+// Run rescans root every interval and saves the index when ctx is done,
+// the persisted index should be loaded before. onRefresh is called after
+// every rescan.
+func (idx *Index) Run(ctx context.Context, interval time.Duration, onRefresh func()) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		idx.Refresh()
+		if onRefresh != nil {
+			onRefresh()
+		}
+		if err := idx.Save(); err != nil {
+			idx.log.Warnf("save index fail: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := idx.Save(); err != nil {
+				idx.log.Warnf("save index fail: %v", err)
+			}
+			return
+		case <-tick:
+		}
+	}
+}
+
+// Refresh walks the whole root, only changed entries are re-detected. The
+// entries not seen by the walk are removed unless they are newer than the
+// walk, which are added by Update during the walk.
+func (idx *Index) Refresh() {
+	start := time.Now()
+	seen := idx.walk(idx.root)
+
+	idx.mu.Lock()
+	for rel, entry := range idx.entries {
+		if !seen[rel] && entry.ModTime < start.Unix() {
+			delete(idx.entries, rel)
+			idx.dirty = true
+		}
+	}
+	count := len(idx.entries)
+	idx.mu.Unlock()
+
+	idx.log.Infof("refresh %d entries in %s", count, time.Since(start))
+}
+
+// Update refreshes the entry of fpath, and all entries below it if it is a dir.
+func (idx *Index) Update(fpath string) {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			idx.Remove(fpath)
+		}
+		return
+	}
+
+	if !fi.IsDir() {
+		if rel, ok := idx.rel(fpath); ok {
+			idx.update(rel, fpath, fi)
+		}
+		return
+	}
+
+	start := time.Now()
+	seen := idx.walk(fpath)
+	prefix, ok := idx.rel(fpath)
+	if !ok {
+		return
+	}
+	idx.mu.Lock()
+	for rel, entry := range idx.entries {
+		if isSubPath(prefix, rel) && !seen[rel] && entry.ModTime < start.Unix() {
+			delete(idx.entries, rel)
+			idx.dirty = true
+		}
+	}
+	idx.mu.Unlock()
+}
+
+// Remove drops the entry of fpath and all entries below it.
+func (idx *Index) Remove(fpath string) {
+	prefix, ok := idx.rel(fpath)
+	if !ok {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for rel := range idx.entries {
+		if rel == prefix || isSubPath(prefix, rel) {
+			delete(idx.entries, rel)
+			idx.dirty = true
+		}
+	}
+}
+
+// Entries returns the entry of rel and all entries below it.
+func (idx *Index) Entries(rel string) []*IndexEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	result := []*IndexEntry{}
+	for entryRel, entry := range idx.entries {
+		if entryRel == rel || isSubPath(rel, entryRel) {
+			copied := *entry
+			result = append(result, &copied)
+		}
+	}
+	return result
+}
+
+func (idx *Index) Get(rel string) (*IndexEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	entry, ok := idx.entries[rel]
+	if !ok {
+		return nil, false
+	}
+	copied := *entry
+	return &copied, true
+}
+
+func (idx *Index) Search(q *SearchQuery) ([]*IndexEntry, error) {
+	match, err := q.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mu.RLock()
+	result := []*IndexEntry{}
+	for rel, entry := range idx.entries {
+		if q.Dir != "" && !isSubPath(q.Dir, rel) {
+			continue
+		}
+		if !q.filter(entry) || !match(entry) {
+			continue
+		}
+		copied := *entry
+		result = append(result, &copied)
+	}
+	idx.mu.RUnlock()
+
+	sort.Slice(result, func(i int, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+
+	return result, nil
+}
+
+func (idx *Index) walk(dir string) map[string]bool {
+	seen := map[string]bool{}
+	filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			idx.log.Warnf("walk %s fail: %v", fpath, err)
+			return nil
+		}
+
+		rel, ok := idx.rel(fpath)
+		if !ok || rel == "" {
+			return nil
+		}
+		if rel == idx.skip { //skip cache dir
+			return filepath.SkipDir
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		seen[rel] = true
+		idx.update(rel, fpath, fi)
+		return nil
+	})
+
+	return seen
+}
+
+func (idx *Index) update(rel string, fpath string, fi fs.FileInfo) {
+	mtime := fi.ModTime().Unix()
+
+	idx.mu.RLock()
+	old, ok := idx.entries[rel]
+	idx.mu.RUnlock()
+	if ok && old.IsDir == fi.IsDir() && old.Size == fi.Size() && old.ModTime == mtime &&
+		(old.IsDir || old.MetaVersion == indexMetaVersion) {
+		return
+	}
+
+	entry := &IndexEntry{
+		Path:    rel,
+		Name:    fi.Name(),
+		IsDir:   fi.IsDir(),
+		Size:    fi.Size(),
+		ModTime: mtime,
+	}
+	if entry.IsDir {
+		entry.Size = 0
+	} else {
+		if mtype, err := mimetype.DetectFile(fpath); err == nil {
+			entry.MimeType = mtype.String()
+		}
+		entry.CaptureTime, entry.GPS = captureMeta(fpath, entry.MimeType)
+		entry.MetaVersion = indexMetaVersion
+	}
+
+	idx.mu.Lock()
+	idx.entries[rel] = entry
+	idx.dirty = true
+	idx.mu.Unlock()
+}
+
+// rel returns the path of fpath relative to the root of the index.
+func (idx *Index) rel(fpath string) (string, bool) {
+	return relSlashPath(idx.root, fpath)
+}
+
+func isSubPath(dir string, rel string) bool {
+	return dir == "" || strings.HasPrefix(rel, dir+"/")
+}
+
+func (q *SearchQuery) filter(entry *IndexEntry) bool {
+	if q.MimeType != "" && !strings.HasPrefix(entry.MimeType, q.MimeType) {
+		return false
+	}
+	if q.MinSize > 0 && entry.Size < q.MinSize {
+		return false
+	}
+	if q.MaxSize > 0 && entry.Size > q.MaxSize {
+		return false
+	}
+	if q.After > 0 && entry.ModTime < q.After {
+		return false
+	}
+	if q.Before > 0 && entry.ModTime > q.Before {
+		return false
+	}
+	return true
+}
+
+// matcher matches the pattern against the display name of the entry, or
+// against its relative path if the pattern contains a "/". All the match
+// modes ignore case.
+func (q *SearchQuery) matcher() (func(*IndexEntry) bool, error) {
+	target := func(entry *IndexEntry) string {
+		if strings.Contains(q.Pattern, "/") {
+			return strings.TrimPrefix(entry.Path, q.Dir+"/")
+		}
+		if entry.IsDir {
+			return entry.Name
+		}
+		return getHashFileName(entry.Name) + filepath.Ext(entry.Name)
+	}
+
+	if q.Pattern == "" {
+		return func(*IndexEntry) bool { return true }, nil
+	}
+
+	switch q.Match {
+	case matchGlob:
+		pattern := strings.ToLower(q.Pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		return func(entry *IndexEntry) bool {
+			ok, _ := path.Match(pattern, strings.ToLower(target(entry)))
+			return ok
+		}, nil
+	case matchRegex:
+		re, err := regexp.Compile("(?i)" + q.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(entry *IndexEntry) bool {
+			return re.MatchString(target(entry))
+		}, nil
+	default:
+		pattern := strings.ToLower(q.Pattern)
+		return func(entry *IndexEntry) bool {
+			return strings.Contains(strings.ToLower(target(entry)), pattern)
+		}, nil
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU is a size bounded cache which evicts the least recently used entries.
+type LRU[K comparable, V any] struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func NewLRU[K comparable, V any](size int) *LRU[K, V] {
+	return &LRU[K, V]{
+		size:  size,
+		ll:    list.New(),
+		items: map[K]*list.Element{},
+	}
+}
+
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		return elem.Value.(*lruEntry[K, V]).value, true
+	}
+	var zero V
+	return zero, false
+}
+
+func (c *LRU[K, V]) Add(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		elem.Value.(*lruEntry[K, V]).value = value
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry[K, V]{key: key, value: value})
+	for c.size > 0 && c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// RemoveFunc removes all entries whose key matches f.
+func (c *LRU[K, V]) RemoveFunc(f func(K) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, elem := range c.items {
+		if f(key) {
+			c.ll.Remove(elem)
+			delete(c.items, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *LRU[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Range calls f for all entries from the least to the most recently used.
+func (c *LRU[K, V]) Range(f func(K, V)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.ll.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*lruEntry[K, V])
+		f(entry.key, entry.value)
+	}
+}
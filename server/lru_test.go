@@ -0,0 +1,47 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c := NewLRU[string, int](3)
+	for i, key := range []string{"a", "b", "c"} {
+		c.Add(key, i)
+	}
+	c.Get("a")
+	c.Add("b", 10)
+	c.Add("d", 3)
+
+	keys := func() []string {
+		keys := []string{}
+		c.Range(func(k string, v int) { keys = append(keys, k) })
+		return keys
+	}
+	if got, want := keys(), []string{"a", "b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+	if _, ok := c.Get("c"); ok {
+		t.Error("the least recently used entry is not evicted")
+	}
+	if v, _ := c.Get("b"); v != 10 {
+		t.Errorf("b = %d, want 10", v)
+	}
+
+	if n := c.RemoveFunc(func(k string) bool { return strings.Contains("ab", k) }); n != 2 {
+		t.Errorf("RemoveFunc removed %d, want 2", n)
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len = %d, want 1", c.Len())
+	}
+
+	unbounded := NewLRU[int, int](0)
+	for i := 0; i < 100; i++ {
+		unbounded.Add(i, i)
+	}
+	if unbounded.Len() != 100 {
+		t.Errorf("Len of unbounded = %d, want 100", unbounded.Len())
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"image"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+const probeTimeout = 10 * time.Second
+
+type MediaInfo struct {
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	Duration   float64 `json:"duration,omitempty"`
+	VideoCodec string  `json:"videoCodec,omitempty"`
+	AudioCodec string  `json:"audioCodec,omitempty"`
+}
+
+type probeStream struct {
+	CodecType    string            `json:"codec_type"`
+	CodecName    string            `json:"codec_name"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	Tags         map[string]string `json:"tags"`
+	SideDataList []struct {
+		Rotation float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+type probeResult struct {
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []*probeStream `json:"streams"`
+}
+
+// mediaInfo returns the dimensions of images and the duration, resolution
+// and codecs of videos and audios, nil if the file is none of them.
+func mediaInfo(path string, mimeType string) *MediaInfo {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return imageMediaInfo(path)
+	case strings.HasPrefix(mimeType, "video/"), strings.HasPrefix(mimeType, "audio/"):
+		return probeMediaInfo(path)
+	}
+	return nil
+}
+
+// imageMediaInfo reads the dimensions from the image header only, the
+// width and height are swapped if the exif orientation rotates the image.
+func imageMediaInfo(path string) *MediaInfo {
+	f, err := os.Open(path)
+	if err != nil {
+		return &MediaInfo{}
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return &MediaInfo{}
+	}
+	info := &MediaInfo{Width: cfg.Width, Height: cfg.Height}
+
+	if _, err := f.Seek(0, 0); err == nil {
+		switch imageOrientation(f) {
+		case "5", "6", "7", "8":
+			info.Width, info.Height = info.Height, info.Width
+		}
+	}
+	return info
+}
+
+func probeMediaInfo(path string) *MediaInfo {
+	result, _, err := probe(path)
+	if err != nil {
+		return &MediaInfo{}
+	}
+
+	info := &MediaInfo{}
+	info.Duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	for _, stream := range result.Streams {
+		switch stream.CodecType {
+		case "video":
+			if info.VideoCodec != "" {
+				continue
+			}
+			info.VideoCodec = stream.CodecName
+			info.Width, info.Height = stream.Width, stream.Height
+			if rotation := stream.rotation(); rotation == 90 || rotation == 270 {
+				info.Width, info.Height = info.Height, info.Width
+			}
+		case "audio":
+			if info.AudioCodec == "" {
+				info.AudioCodec = stream.CodecName
+			}
+		}
+	}
+	return info
+}
+
+// probe runs ffprobe on path, the raw json output is returned too.
+func probe(path string) (*probeResult, []byte, error) {
+	out, err := ffmpeg.ProbeWithTimeout(path, probeTimeout, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &probeResult{}
+	if err := json.Unmarshal([]byte(out), result); err != nil {
+		return nil, nil, err
+	}
+	return result, []byte(out), nil
+}
+
+func (s *probeStream) rotation() int {
+	rotation := 0.0
+	if v, err := strconv.ParseFloat(s.Tags["rotate"], 64); err == nil {
+		rotation = v
+	}
+	for _, side := range s.SideDataList {
+		if side.Rotation != 0 {
+			rotation = side.Rotation
+		}
+	}
+
+	r := int(math.Round(rotation)) % 360
+	if r < 0 {
+		r += 360
+	}
+	return r
+}
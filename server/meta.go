@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const metaCacheSize = 1000
+
+type Metadata struct {
+	MimeType string          `json:"mimeType"`
+	Media    *MediaInfo      `json:"media,omitempty"`
+	Summary  *ExifSummary    `json:"summary,omitempty"`
+	Exif     json.RawMessage `json:"exif,omitempty"`
+	XMP      string          `json:"xmp,omitempty"`
+	Probe    json.RawMessage `json:"probe,omitempty"`
+}
+
+// Meta returns the exif and xmp of images and the ffprobe output of
+// videos and audios, without the metadata stripped by the policy of path.
+func (s *Server) Meta(e echo.Context, path string, fi fs.FileInfo) error {
+	mode := stripModeOf(getRelSlashPath(path), e.QueryParam("strip"))
+	mtime := fi.ModTime().Unix()
+	key := fmt.Sprintf("%s#%d", path, mtime)
+	if meta, ok := s.metas.Get(key); ok {
+		return e.JSON(http.StatusOK, meta.stripped(mode))
+	}
+
+	fileMeta := s.mimeTypes.GetMedia(path, mtime)
+	meta := &Metadata{
+		MimeType: fileMeta.MimeType,
+		Media:    fileMeta.Media,
+	}
+	if meta.Media != nil && *meta.Media == (MediaInfo{}) {
+		meta.Media = nil
+	}
+
+	switch {
+	case strings.HasPrefix(meta.MimeType, "image/"):
+		if x, err := readExif(path); err == nil {
+			meta.Summary = exifSummary(x)
+			meta.Exif = exifTags(x)
+		}
+		meta.XMP = readXMP(path)
+	case strings.HasPrefix(meta.MimeType, "video/"), strings.HasPrefix(meta.MimeType, "audio/"):
+		if _, raw, err := probe(path); err == nil {
+			meta.Probe = relProbeFilename(raw, getRelSlashPath(path))
+		}
+	}
+
+	s.metas.Add(key, meta)
+	return e.JSON(http.StatusOK, meta.stripped(mode))
+}
+
+// relProbeFilename replaces the absolute format.filename of the ffprobe
+// output with rel, the path on the server is not shown to clients.
+func relProbeFilename(data json.RawMessage, rel string) json.RawMessage {
+	result := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil
+	}
+	format := map[string]json.RawMessage{}
+	if err := json.Unmarshal(result["format"], &format); err != nil {
+		return data
+	}
+	if _, ok := format["filename"]; !ok {
+		return data
+	}
+	format["filename"], _ = json.Marshal(rel)
+	result["format"], _ = json.Marshal(format)
+	filtered, err := json.Marshal(result)
+	if err != nil {
+		return nil
+	}
+	return filtered
+}
+
+// stripped returns a copy of m without the metadata removed by mode, the
+// same as stripMetadata does for the served images. Only the orientation
+// is kept by StripAll.
+func (m *Metadata) stripped(mode StripMode) *Metadata {
+	if mode == StripNone {
+		return m
+	}
+
+	result := *m
+	result.XMP = ""
+	if m.Summary != nil {
+		summary := *m.Summary
+		summary.GPS = nil
+		if mode == StripAll {
+			summary = ExifSummary{Orientation: m.Summary.Orientation}
+		}
+		result.Summary = &summary
+	}
+	result.Exif = filterJSONKeys(m.Exif, func(key string) bool {
+		if mode == StripAll {
+			return key == "Orientation"
+		}
+		return !strings.HasPrefix(key, "GPS")
+	})
+	result.Probe = stripProbeTags(m.Probe, mode)
+	return &result
+}
+
+// filterJSONKeys returns the object data with only the keys accepted by
+// keep, nil if data is not an object.
+func filterJSONKeys(data json.RawMessage, keep func(string) bool) json.RawMessage {
+	if data == nil {
+		return nil
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	for k := range fields {
+		if !keep(k) {
+			delete(fields, k)
+		}
+	}
+	filtered, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return filtered
+}
+
+// stripProbeTags removes the location tags of the format and the streams
+// in the ffprobe output, or all the tags for StripAll.
+func stripProbeTags(data json.RawMessage, mode StripMode) json.RawMessage {
+	if data == nil {
+		return nil
+	}
+	result := map[string]any{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil
+	}
+
+	stripTags := func(v any) {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return
+		}
+		if mode == StripAll {
+			delete(obj, "tags")
+			return
+		}
+		tags, _ := obj["tags"].(map[string]any)
+		for k := range tags {
+			if strings.Contains(strings.ToLower(k), "location") {
+				delete(tags, k)
+			}
+		}
+	}
+	stripTags(result["format"])
+	streams, _ := result["streams"].([]any)
+	for _, stream := range streams {
+		stripTags(stream)
+	}
+
+	stripped, err := json.Marshal(result)
+	if err != nil {
+		return nil
+	}
+	return stripped
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mama/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+const (
+	mimeCacheFileName     = "mimetype.json"
+	mimeCacheSaveInterval = time.Minute
+)
+
+type fileMeta struct {
+	MimeType string     `json:"mimeType"`
+	Media    *MediaInfo `json:"media,omitempty"`
+}
+
+type mimeCacheItem struct {
+	Key  string    `json:"key"`
+	Meta *fileMeta `json:"meta"`
+}
+
+// MimeCache caches the detected metadata of files by path and mtime, it
+// is bounded in size and persisted in the cache dir.
+type MimeCache struct {
+	file  string
+	lru   *LRU[string, *fileMeta]
+	dirty atomic.Bool
+	log   *log.Log
+}
+
+func NewMimeCache(root string, cacheDir string, size int) *MimeCache {
+	return &MimeCache{
+		file: filepath.Join(root, cacheDir, mimeCacheFileName),
+		lru:  NewLRU[string, *fileMeta](size),
+		log:  log.L.WithNewPrefix("mimecache"),
+	}
+}
+
+// Get returns the metadata of path, the file is sniffed without holding
+// the cache lock if it is not cached yet.
+func (c *MimeCache) Get(path string, mtime int64) *fileMeta {
+	key := fmt.Sprintf("%s#%d", path, mtime)
+	if meta, ok := c.lru.Get(key); ok {
+		return meta
+	}
+
+	meta := &fileMeta{}
+	mtype, err := mimetype.DetectFile(path)
+	if err != nil {
+		return meta
+	}
+	meta.MimeType = mtype.String()
+
+	c.lru.Add(key, meta)
+	c.dirty.Store(true)
+	return meta
+}
+
+// GetMedia returns the metadata of path with the media info, which is
+// probed on first use since it is expensive for videos.
+func (c *MimeCache) GetMedia(path string, mtime int64) *fileMeta {
+	meta := c.Get(path, mtime)
+	if meta.Media != nil || meta.MimeType == "" {
+		return meta
+	}
+
+	withMedia := &fileMeta{
+		MimeType: meta.MimeType,
+		Media:    mediaInfo(path, meta.MimeType),
+	}
+	if withMedia.Media == nil {
+		withMedia.Media = &MediaInfo{}
+	}
+	c.lru.Add(fmt.Sprintf("%s#%d", path, mtime), withMedia)
+	c.dirty.Store(true)
+	return withMedia
+}
+
+// Invalidate removes the entries of fpath and of all files below it.
+func (c *MimeCache) Invalidate(fpath string) {
+	removed := c.lru.RemoveFunc(func(key string) bool {
+		return strings.HasPrefix(key, fpath+"#") || strings.HasPrefix(key, fpath+"/")
+	})
+	if removed > 0 {
+		c.dirty.Store(true)
+	}
+}
+
+func (c *MimeCache) Load() error {
+	data, err := os.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+
+	items := []*mimeCacheItem{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.Meta != nil {
+			c.lru.Add(item.Key, item.Meta)
+		}
+	}
+	return nil
+}
+
+func (c *MimeCache) Save() error {
+	if !c.dirty.Swap(false) {
+		return nil
+	}
+
+	items := make([]*mimeCacheItem, 0, c.lru.Len())
+	c.lru.Range(func(key string, meta *fileMeta) {
+		items = append(items, &mimeCacheItem{Key: key, Meta: meta})
+	})
+	data, err := json.Marshal(items)
+	if err == nil {
+		tmp := c.file + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, c.file)
+		}
+	}
+	if err != nil {
+		// saved again next time
+		c.dirty.Store(true)
+	}
+	return err
+}
+
+// Run loads the persisted cache and saves it periodically until ctx is done.
+func (c *MimeCache) Run(ctx context.Context) {
+	if err := c.Load(); err != nil && !os.IsNotExist(err) {
+		c.log.Warnf("load mime cache fail: %v", err)
+	}
+
+	ticker := time.NewTicker(mimeCacheSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := c.Save(); err != nil {
+				c.log.Warnf("save mime cache fail: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := c.Save(); err != nil {
+				c.log.Warnf("save mime cache fail: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"io"
+	"io/fs"
+	"mama/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultSearchLimit = 200
+	maxSearchLimit     = 5000
+	// the snippets of grep are taken from the start of the files only
+	grepSnippetSize = 256 << 10
+)
+
+func (s *Server) Search(e echo.Context, path string, fi fs.FileInfo) error {
+	dir, ok := s.index.rel(path)
+	if !ok {
+		return e.String(http.StatusNotFound, "file not found")
+	}
+
+	q := SearchQuery{
+		Dir:      dir,
+		Pattern:  e.QueryParam("search"),
+		Match:    e.QueryParam("match"),
+		MimeType: e.QueryParam("mime"),
+		MinSize:  parseInt64Param(e, "minSize"),
+		MaxSize:  parseInt64Param(e, "maxSize"),
+		After:    parseTimeParam(e, "after"),
+		Before:   parseTimeParam(e, "before"),
+		Limit:    int(parseInt64Param(e, "limit")),
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultSearchLimit
+	}
+	if q.Limit > maxSearchLimit {
+		q.Limit = maxSearchLimit
+	}
+
+	entries, err := s.index.Search(&q)
+	if err != nil {
+		return e.String(http.StatusBadRequest, "invalid search pattern: "+err.Error())
+	}
+
+	info := s.convertFileInfo(path, fi)
+	for _, entry := range entries {
+		subInfo := s.convertIndexEntry(entry)
+		if subInfo.IsDir {
+			info.Dirs = append(info.Dirs, subInfo)
+		} else {
+			info.Files = append(info.Files, subInfo)
+		}
+	}
+
+	return e.JSON(http.StatusOK, &info)
+}
+
+func (s *Server) convertIndexEntry(entry *IndexEntry) *HTTPFileInfo {
+	info := HTTPFileInfo{
+		Name:     entry.Name,
+		FileName: entry.Name,
+		Path:     filepath.FromSlash(entry.Path),
+		IsDir:    entry.IsDir,
+		Dirs:     []*HTTPFileInfo{},
+		Files:    []*HTTPFileInfo{},
+	}
+
+	if !info.IsDir {
+		info.FileExt = filepath.Ext(info.Name)
+		info.Name = getHashFileName(info.Name)
+		info.ModTime = entry.ModTime
+		info.Size = entry.Size
+		info.MimeType = entry.MimeType
+	}
+
+	return &info
+}
+
+func parseInt64Param(e echo.Context, key string) int64 {
+	v, _ := strconv.ParseInt(e.QueryParam(key), 10, 64)
+	return v
+}
+
+// parseTimeParam accepts unix seconds, RFC3339 or a plain date.
+func parseTimeParam(e echo.Context, key string) int64 {
+	v := e.QueryParam(key)
+	if v == "" {
+		return 0
+	}
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return i
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t.Unix()
+		}
+	}
+	return 0
+}
+
+func (s *Server) Grep(e echo.Context, path string, fi fs.FileInfo) error {
+	if s.fulltext == nil {
+		return e.String(http.StatusNotImplemented, "full text search is disabled")
+	}
+
+	dir, ok := s.index.rel(path)
+	if !ok {
+		return e.String(http.StatusNotFound, "file not found")
+	}
+
+	// every hit is read for its snippets
+	limit := int(parseInt64Param(e, "limit"))
+	if limit <= 0 || limit > defaultSearchLimit {
+		limit = defaultSearchLimit
+	}
+
+	query := e.QueryParam("grep")
+	info := s.convertFileInfo(path, fi)
+	for _, rel := range s.fulltext.Search(dir, query, limit) {
+		entry, ok := s.index.Get(rel)
+		if !ok {
+			continue
+		}
+		data, err := readPrefix(filepath.Join(config.C.Dir, filepath.FromSlash(rel)), grepSnippetSize)
+		if err != nil {
+			continue
+		}
+		subInfo := s.convertIndexEntry(entry)
+		subInfo.Snippets = highlight(strings.ToValidUTF8(string(data), ""), query)
+		info.Files = append(info.Files, subInfo)
+	}
+
+	return e.JSON(http.StatusOK, &info)
+}
+
+// readPrefix reads up to n bytes from the start of the file at path.
+func readPrefix(path string, n int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, n))
+}
+
+func (s *Server) updateIndex(fpath string) {
+	s.index.Update(fpath)
+	if s.fulltext == nil {
+		return
+	}
+	if rel, ok := s.index.rel(fpath); ok {
+		for _, entry := range s.index.Entries(rel) {
+			s.fulltext.Update(entry)
+		}
+	}
+}
+
+func (s *Server) removeIndex(fpath string) {
+	rel, ok := s.index.rel(fpath)
+	if !ok {
+		return
+	}
+	s.index.Remove(fpath)
+	if s.fulltext != nil {
+		s.fulltext.Remove(rel)
+	}
+}
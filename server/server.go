@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/fs"
 	"mama/config"
+	"mama/log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"slices"
 	"sync"
@@ -17,11 +19,18 @@ import (
 
 type Server struct {
 	*echo.Echo
-	cacheDir      string
-	bufPool       sync.Pool
-	mimeTypeCache map[string]string
-	mimeTypeMutex sync.Mutex
-	transform     *Transform
+	cacheDir  string
+	bufPool   sync.Pool
+	mimeTypes *MimeCache
+	metas     *LRU[string, *Metadata]
+	transform *Transform
+	hls       *HLS
+	index     *Index
+	fulltext  *FullText
+	bus       *EventBus
+	recent    map[string]time.Time
+	writing   map[string]int
+	recentMu  sync.Mutex
 }
 
 func Run(ctx context.Context, staticFs fs.FS) error {
@@ -29,15 +38,22 @@ func Run(ctx context.Context, staticFs fs.FS) error {
 	server := Server{
 		Echo:      echo.New(),
 		cacheDir:  CACHE_DIR,
-		transform: NewTransform(filepath.Join(config.C.Dir, CACHE_DIR)),
+		transform: NewTransform(OpenTransformCache(), config.C.Transform.Workers, config.C.Transform.QueueTimeout),
+		index:     NewIndex(config.C.Dir, CACHE_DIR),
 		bufPool: sync.Pool{
 			New: func() interface{} { return make([]byte, 32*1024) },
 		},
-		mimeTypeCache: map[string]string{},
+		mimeTypes: NewMimeCache(config.C.Dir, CACHE_DIR, config.C.Mime.CacheSize),
+		metas:     NewLRU[string, *Metadata](metaCacheSize),
+		bus:       NewEventBus(),
+		recent:    map[string]time.Time{},
+		writing:   map[string]int{},
 	}
 
 	server.HideBanner = true
-	server.Use(middleware.Gzip())
+	server.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+		Skipper: isWatchRequest,
+	}))
 	server.Use(middleware.Logger())
 	server.Use(middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
 		Skipper: func(e echo.Context) bool {
@@ -67,6 +83,53 @@ func Run(ctx context.Context, staticFs fs.FS) error {
 		HTML5:      true,
 	}))
 
+	// loaded before the watcher and the api can change the index
+	if err := server.index.Load(); err != nil && !os.IsNotExist(err) {
+		log.Warnf("load index fail: %v", err)
+	}
+	if config.C.FullText.Enable {
+		server.fulltext = NewFullText(config.C.Dir, CACHE_DIR, config.C.FullText.MaxFileSize)
+		if err := server.fulltext.Load(); err != nil && !os.IsNotExist(err) {
+			log.Warnf("load fulltext index fail: %v", err)
+		}
+	}
+
+	bg := sync.WaitGroup{}
+	if config.C.HLS.Enable {
+		server.hls = NewHLS(filepath.Join(config.C.Dir, CACHE_DIR, HLS_CACHE_DIR), config.C.HLS)
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			server.hls.Run(ctx)
+		}()
+	}
+
+	bg.Add(3)
+	go func() {
+		defer bg.Done()
+		server.transform.cache.Run(ctx, config.C.Transform.CachePruneInterval)
+	}()
+	go func() {
+		defer bg.Done()
+		server.mimeTypes.Run(ctx)
+	}()
+	go func() {
+		defer bg.Done()
+		server.index.Run(ctx, config.C.Index.Interval, func() {
+			if server.fulltext != nil {
+				server.fulltext.Sync(server.index.Entries(""))
+				if err := server.fulltext.Save(); err != nil {
+					log.Warnf("save fulltext index fail: %v", err)
+				}
+			}
+		})
+	}()
+
+	if config.C.Watch.Enable {
+		watcher := NewWatcher(config.C.Dir, CACHE_DIR, config.C.Watch.PollInterval, config.C.Watch.Poll, server.onWatchEvent)
+		go watcher.Run(ctx)
+	}
+
 	go func() {
 		if err := server.Start(fmt.Sprintf("%s:%d", config.C.Addr, config.C.Port)); err != nil && err != http.ErrServerClosed {
 			server.Logger.Fatal("shutting down the server")
@@ -74,11 +137,13 @@ func Run(ctx context.Context, staticFs fs.FS) error {
 	}()
 
 	<-ctx.Done()
+	server.bus.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := server.Shutdown(ctx); err != nil {
 		server.Logger.Fatal(err)
 	}
+	bg.Wait()
 
 	return nil
 }
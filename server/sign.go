@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"mama/config"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	urlQuerySignKey   = "sig"
+	urlQueryExpireKey = "exp"
+)
+
+var (
+	errSignMissing = errors.New("signature is missing")
+	errSignInvalid = errors.New("signature is invalid")
+	errSignExpired = errors.New("signature is expired")
+)
+
+type SignedURL struct {
+	URL    string `json:"url"`
+	Expire int64  `json:"exp,omitempty"`
+}
+
+// SignTransform returns the signature of the transform param t of the file
+// rel, which expires at exp if exp is not 0.
+func SignTransform(secret string, rel string, t string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(rel))
+	mac.Write([]byte{0})
+	mac.Write([]byte(t))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignURL returns the signed url of the transform param t of the file rel,
+// the url never expires if ttl is 0.
+func SignURL(rel string, t string, ttl time.Duration) *SignedURL {
+	rel = path.Clean("/" + filepath.ToSlash(rel))[1:]
+
+	var exp int64
+	if ttl > 0 {
+		exp = time.Now().Add(ttl).Unix()
+	}
+
+	query := url.Values{}
+	query.Set(urlQueryParamKey, t)
+	if exp != 0 {
+		query.Set(urlQueryExpireKey, strconv.FormatInt(exp, 10))
+	}
+	query.Set(urlQuerySignKey, SignTransform(config.C.Transform.Secret, rel, t, exp))
+
+	return &SignedURL{
+		URL:    (&url.URL{Path: path.Join("/", config.C.BasePath, "-", rel)}).EscapedPath() + "?" + query.Encode(),
+		Expire: exp,
+	}
+}
+
+// verifySign checks the signature of the transform param t of the file rel.
+func verifySign(rel string, t string, exp string, sig string) error {
+	if sig == "" {
+		return errSignMissing
+	}
+
+	var expire int64
+	if exp != "" {
+		var err error
+		if expire, err = strconv.ParseInt(exp, 10, 64); err != nil {
+			return errSignInvalid
+		}
+	}
+
+	expected := SignTransform(config.C.Transform.Secret, rel, t, expire)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return errSignInvalid
+	}
+	if expire != 0 && time.Now().Unix() > expire {
+		return errSignExpired
+	}
+	return nil
+}
+
+// Sign returns the signed url of the transform param t of the file, with an
+// optional ttl like 24h.
+func (s *Server) Sign(e echo.Context, fpath string) error {
+	if config.C.Transform.Secret == "" {
+		return e.String(http.StatusBadRequest, "transform secret is not configured")
+	}
+
+	t := e.FormValue(urlQueryParamKey)
+	if t == "" {
+		return e.String(http.StatusBadRequest, "t is required")
+	}
+
+	var ttl time.Duration
+	if v := e.FormValue("ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil || ttl < 0 {
+			return e.String(http.StatusBadRequest, "ttl should be a duration like 24h")
+		}
+	}
+
+	return e.JSON(http.StatusOK, SignURL(getRelSlashPath(fpath), t, ttl))
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"mama/config"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignURL(t *testing.T) {
+	config.C.Transform.Secret = "secret"
+	config.C.BasePath = "/base"
+	defer func() {
+		config.C.Transform.Secret = ""
+		config.C.BasePath = ""
+	}()
+
+	tests := []struct {
+		rel  string
+		path string
+	}{
+		{"photos/a.jpg", "/base/-/photos/a.jpg"},
+		{"photos/a b#1.jpg", "/base/-/photos/a b#1.jpg"},
+		{"photos/what?.jpg", "/base/-/photos/what?.jpg"},
+		{"照片/é 100%.jpg", "/base/-/照片/é 100%.jpg"},
+		{"/photos/../a.jpg", "/base/-/a.jpg"},
+	}
+	for _, tt := range tests {
+		signed := SignURL(tt.rel, "op=resize,w=100|op=blur,v=2", time.Hour)
+		u, err := url.Parse(signed.URL)
+		if err != nil {
+			t.Errorf("%q: parse %s: %v", tt.rel, signed.URL, err)
+			continue
+		}
+		if u.Path != tt.path {
+			t.Errorf("%q: path = %q, want %q", tt.rel, u.Path, tt.path)
+		}
+		if u.Fragment != "" {
+			t.Errorf("%q: unexpected fragment %q", tt.rel, u.Fragment)
+		}
+
+		query := u.Query()
+		rel := strings.TrimPrefix(u.Path, "/base/-/")
+		if err := verifySign(rel, query.Get(urlQueryParamKey), query.Get(urlQueryExpireKey), query.Get(urlQuerySignKey)); err != nil {
+			t.Errorf("%q: verify: %v", tt.rel, err)
+		}
+		if err := verifySign(rel, "op=resize,w=200", query.Get(urlQueryExpireKey), query.Get(urlQuerySignKey)); err != errSignInvalid {
+			t.Errorf("%q: verify tampered t = %v, want %v", tt.rel, err, errSignInvalid)
+		}
+		if err := verifySign(rel+"x", query.Get(urlQueryParamKey), query.Get(urlQueryExpireKey), query.Get(urlQuerySignKey)); err != errSignInvalid {
+			t.Errorf("%q: verify other file = %v, want %v", tt.rel, err, errSignInvalid)
+		}
+	}
+}
+
+func TestVerifySign(t *testing.T) {
+	config.C.Transform.Secret = "secret"
+	defer func() { config.C.Transform.Secret = "" }()
+
+	rel, param := "a b/#1?.jpg", "op=blur,v=2"
+	past := time.Now().Add(-time.Minute).Unix()
+	future := time.Now().Add(time.Minute).Unix()
+	tests := []struct {
+		name string
+		exp  string
+		sig  string
+		want error
+	}{
+		{"no expire", "", SignTransform("secret", rel, param, 0), nil},
+		{"not expired", itoa(future), SignTransform("secret", rel, param, future), nil},
+		{"expired", itoa(past), SignTransform("secret", rel, param, past), errSignExpired},
+		{"expire changed", itoa(future + 1), SignTransform("secret", rel, param, future), errSignInvalid},
+		{"expire removed", "", SignTransform("secret", rel, param, future), errSignInvalid},
+		{"bad expire", "soon", SignTransform("secret", rel, param, 0), errSignInvalid},
+		{"other secret", "", SignTransform("other", rel, param, 0), errSignInvalid},
+		{"missing", "", "", errSignMissing},
+	}
+	for _, tt := range tests {
+		if err := verifySign(rel, param, tt.exp, tt.sig); err != tt.want {
+			t.Errorf("%s: verifySign = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func itoa(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
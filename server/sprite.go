@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"mama/log"
+	"math"
+	"net/url"
+	"strconv"
+
+	"github.com/nao1215/imaging"
+)
+
+const (
+	opSprite     = "sprite"
+	spriteVTTKey = "vtt"
+
+	defaultSpriteCount = 10
+	maxSpriteCount     = 100
+	defaultSpriteWidth = 160
+	maxSpriteWidth     = 1920
+)
+
+// transformSprite makes a grid of count evenly spaced frames of a video, or
+// the WebVTT thumbnail track of the grid if op.vtt is set.
+func transformSprite(op *TransformOp, log *log.Log) error {
+	log.Infof("start sprite with params: n=%d cols=%d w=%d h=%d vtt=%t format=%s", op.count, op.cols, op.w, op.h, op.vtt != "", op.format)
+
+	result, _, err := probe(op.file.path)
+	if err != nil {
+		return err
+	}
+	duration, _ := strconv.ParseFloat(result.Format.Duration, 64)
+	if duration <= 0 {
+		return unsupportedSource("unknown video duration")
+	}
+
+	count, cols, tileWidth, tileHeight := op.count, op.cols, op.w, op.h
+	if count <= 0 {
+		count = defaultSpriteCount
+	}
+	if cols <= 0 {
+		cols = int(math.Ceil(math.Sqrt(float64(count))))
+	}
+	cols = min(cols, count)
+	rows := (count + cols - 1) / cols
+	if tileWidth <= 0 {
+		tileWidth = defaultSpriteWidth
+	}
+	if tileHeight <= 0 {
+		info := probeMediaInfo(op.file.path)
+		if info.Width <= 0 || info.Height <= 0 {
+			return unsupportedSource("unknown video resolution")
+		}
+		tileHeight = max(1, int(math.Round(float64(tileWidth)*float64(info.Height)/float64(info.Width))))
+		// tall videos are limited by the height of the tiles
+		if tileHeight > maxSpriteWidth {
+			tileWidth = max(1, tileWidth*maxSpriteWidth/tileHeight)
+			tileHeight = maxSpriteWidth
+		}
+	}
+	if err := checkOutputSize(op, cols*tileWidth, rows*tileHeight); err != nil {
+		return err
+	}
+
+	if op.vtt != "" {
+		vtt := bytes.NewBufferString("WEBVTT\n")
+		for i := 0; i < count; i++ {
+			x, y := i%cols*tileWidth, i/cols*tileHeight
+			fmt.Fprintf(vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+				formatVTTTime(duration*float64(i)/float64(count)), formatVTTTime(duration*float64(i+1)/float64(count)),
+				op.vtt, x, y, tileWidth, tileHeight)
+		}
+		op.result = vtt.Bytes()
+		return nil
+	}
+
+	sprite := imaging.New(cols*tileWidth, rows*tileHeight, color.Black)
+	for i := 0; i < count; i++ {
+		// the middle of each interval, the first and the last frames are
+		// often black
+		if err := op.ctx.Err(); err != nil {
+			return err
+		}
+		frame, err := videoSnapshotAt(op.ctx, op.file.path, duration*(float64(i)+0.5)/float64(count))
+		if err != nil {
+			return err
+		}
+		img, err := imageDecodeBytes(op.ctx, frame)
+		if err != nil {
+			return err
+		}
+		tile := imaging.Resize(img, tileWidth, tileHeight, imaging.Lanczos)
+		sprite = imaging.Paste(sprite, tile, image.Pt(i%cols*tileWidth, i/cols*tileHeight))
+	}
+
+	data, err := imageToBytes(sprite, op.format, op.quality, op.lossless)
+	if err != nil {
+		return err
+	}
+	op.result = data
+	return nil
+}
+
+// spriteVTTURL returns the url of the sprite image relative to the vtt url,
+// which is the same request without the vtt query.
+func spriteVTTURL(name string, query url.Values) string {
+	params := url.Values{}
+	for k, v := range query {
+		if k != spriteVTTKey {
+			params[k] = v
+		}
+	}
+	return url.PathEscape(name) + "?" + params.Encode()
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const sseHeartbeat = 30 * time.Second
+
+// Watch streams the change events of the watched dirs as server-sent
+// events. The dir of the request is always watched, more dirs can be
+// added with the path query, and recursive includes all changes below
+// the dirs instead of only their direct children.
+func (s *Server) Watch(e echo.Context, pathParam string) error {
+	dirs := []string{getRelSlashPath(s.getFilePath(pathParam))}
+	for _, p := range e.QueryParams()["path"] {
+		p, _ = url.QueryUnescape(p)
+		dirs = append(dirs, getRelSlashPath(s.getFilePath(p)))
+	}
+	_, recursive := e.QueryParams()["recursive"]
+
+	match := func(rel string) bool {
+		if rel == "" {
+			return false
+		}
+		for _, dir := range dirs {
+			if rel == dir || path.Dir(rel) == dir || (dir == "" && path.Dir(rel) == ".") {
+				return true
+			}
+			if recursive && isSubPath(dir, rel) {
+				return true
+			}
+		}
+		return false
+	}
+
+	sub := s.bus.Subscribe()
+	defer sub.Close()
+
+	w := e.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", 3000)
+	w.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-e.Request().Context().Done():
+			return nil
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			w.Flush()
+
+		case ev, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			if !match(ev.Path) && !match(ev.OldPath) {
+				continue
+			}
+
+			data, err := json.Marshal(&ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			w.Flush()
+		}
+	}
+}
+
+func isWatchRequest(e echo.Context) bool {
+	_, ok := e.QueryParams()["watch"]
+	return ok && e.Request().Method == http.MethodGet
+}
@@ -0,0 +1,493 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"mama/config"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// StripMode is the level of metadata removed from served images, a
+// higher level removes more.
+type StripMode int
+
+const (
+	StripNone StripMode = iota
+	StripLocation
+	StripAll
+)
+
+var StripModeNames = map[StripMode]string{
+	StripNone:     "keep",
+	StripLocation: "location",
+	StripAll:      "all",
+}
+
+func ParseStripMode(text string) StripMode {
+	lower := strings.ToLower(text)
+	for mode, name := range StripModeNames {
+		if lower == name {
+			return mode
+		}
+	}
+	return StripNone
+}
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegXMPHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+	pngXMPKeyword  = []byte("XML:com.adobe.xmp\x00")
+	riffHeader     = []byte("RIFF")
+	webpHeader     = []byte("WEBP")
+)
+
+const (
+	jpegExifScanSize = 256 << 10
+	// larger exif chunks of png are dropped instead of read into memory
+	pngExifMaxSize = 1 << 20
+
+	// bytes needed by isStrippable
+	stripHeadSize = 12
+
+	// webp flags of the vp8x chunk
+	webpFlagXMP = 0x04
+
+	tiffTagOrientation = 0x0112
+	tiffTagGPSIFD      = 0x8825
+)
+
+// stripModeOf returns the configured mode of the file at rel, the longest
+// matching rule wins. A request can only ask to strip more.
+func stripModeOf(rel string, request string) StripMode {
+	mode := ParseStripMode(config.C.Exif.Strip)
+	matched := -1
+	for _, rule := range config.C.Exif.Rules {
+		prefix := strings.Trim(filepath.ToSlash(rule.Path), "/")
+		if (prefix == "" || rel == prefix || strings.HasPrefix(rel, prefix+"/")) && len(prefix) > matched {
+			mode = ParseStripMode(rule.Strip)
+			matched = len(prefix)
+		}
+	}
+
+	if requested := ParseStripMode(request); requested > mode {
+		mode = requested
+	}
+	return mode
+}
+
+// stripMetadata copies the jpeg, png or webp from r to w without the
+// metadata removed by mode, other formats are copied unchanged. The exif
+// orientation is kept so the image is still displayed the right way up.
+// Only the metadata is read into memory, the image data is streamed.
+func stripMetadata(w io.Writer, r io.Reader, mode StripMode) error {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(stripHeadSize)
+	switch {
+	case mode == StripNone:
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+		return stripJPEG(w, br, mode)
+	case bytes.HasPrefix(head, pngSignature):
+		return stripPNG(w, br, mode)
+	case isWebP(head):
+		return stripWebP(w, br, mode)
+	}
+	_, err := io.Copy(w, br)
+	return err
+}
+
+// isStrippable reports whether the data starting with head is a jpeg, png
+// or webp handled by stripMetadata.
+func isStrippable(head []byte) bool {
+	return bytes.HasPrefix(head, []byte{0xFF, 0xD8}) || bytes.HasPrefix(head, pngSignature) || isWebP(head)
+}
+
+// isMetadataFree reports whether a file of mimeType can't carry the
+// metadata stripped by stripMetadata, e.g. gif and svg may have xmp.
+func isMetadataFree(mimeType string) bool {
+	switch mimeType {
+	case "image/bmp", "image/x-icon", "image/vnd.microsoft.icon":
+		return true
+	}
+	return !strings.HasPrefix(mimeType, "image/")
+}
+
+func isWebP(head []byte) bool {
+	return len(head) >= 12 && bytes.HasPrefix(head, riffHeader) && bytes.Equal(head[8:12], webpHeader)
+}
+
+// stripJPEG filters the segments before the start of scan, the rest is
+// copied as is, so is everything after a malformed segment.
+func stripJPEG(w io.Writer, r *bufio.Reader, mode StripMode) error {
+	if _, err := io.CopyN(w, r, 2); err != nil {
+		return err
+	}
+
+	for {
+		head, err := r.Peek(4)
+		if err != nil || head[0] != 0xFF {
+			break
+		}
+		marker := head[1]
+		if marker == 0xDA { // start of scan, the rest is image data
+			break
+		}
+		length := int(binary.BigEndian.Uint16(head[2:]))
+		if length < 2 {
+			break
+		}
+		seg := make([]byte, 2+length)
+		if n, err := io.ReadFull(r, seg); err != nil {
+			// a truncated file is served as truncated
+			w.Write(seg[:n])
+			return err
+		}
+		payload := seg[4:]
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegExifHeader):
+			tiff := payload[len(jpegExifHeader):]
+			if mode == StripAll {
+				orientation := tiffOrientation(tiff)
+				if orientation <= 1 {
+					continue
+				}
+				tiff = orientationTIFF(orientation)
+			} else {
+				blankGPS(tiff)
+			}
+			app1 := append(append([]byte{}, jpegExifHeader...), tiff...)
+			w.Write([]byte{0xFF, 0xE1})
+			binary.Write(w, binary.BigEndian, uint16(len(app1)+2))
+			if _, err := w.Write(app1); err != nil {
+				return err
+			}
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegXMPHeader):
+			// xmp may carry the location too
+			continue
+		case mode == StripAll && (marker == 0xE1 || marker == 0xED || marker == 0xFE):
+			// other app1, iptc and comments
+			continue
+		default:
+			if _, err := w.Write(seg); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// stripPNG filters the metadata chunks, the other chunks are copied as they
+// are read.
+func stripPNG(w io.Writer, r *bufio.Reader, mode StripMode) error {
+	if _, err := io.CopyN(w, r, int64(len(pngSignature))); err != nil {
+		return err
+	}
+
+	for {
+		head, err := r.Peek(8)
+		if err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(head))
+		if length > math.MaxInt32 {
+			break
+		}
+		typ := string(head[4:8])
+		size := 12 + length
+
+		keep := true
+		switch typ {
+		case "eXIf":
+			if length > pngExifMaxSize {
+				keep = false
+				break
+			}
+			chunk := make([]byte, size)
+			if n, err := io.ReadFull(r, chunk); err != nil {
+				w.Write(chunk[:n])
+				return err
+			}
+			tiff := chunk[8 : 8+length]
+			if mode == StripAll {
+				orientation := tiffOrientation(tiff)
+				if orientation <= 1 {
+					continue
+				}
+				tiff = orientationTIFF(orientation)
+			} else {
+				blankGPS(tiff)
+			}
+			if err := writePNGChunk(w, typ, tiff); err != nil {
+				return err
+			}
+			continue
+		case "iTXt":
+			prefix, _ := r.Peek(8 + len(pngXMPKeyword))
+			keep = mode != StripAll && !bytes.HasPrefix(prefix[8:], pngXMPKeyword)
+		case "tEXt", "zTXt", "tIME":
+			keep = mode != StripAll
+		}
+
+		dst := w
+		if !keep {
+			dst = io.Discard
+		}
+		if _, err := io.CopyN(dst, r, size); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// stripWebP filters the metadata chunks of a webp. The size of the file is
+// in its header, so the chunks keep their sizes: the exif is rewritten in
+// place and the removed chunks are zeroed and renamed to JUNK, which the
+// readers skip.
+func stripWebP(w io.Writer, r *bufio.Reader, mode StripMode) error {
+	if _, err := io.CopyN(w, r, 12); err != nil {
+		return err
+	}
+
+	for {
+		head, err := r.Peek(8)
+		if err != nil {
+			break
+		}
+		typ := string(head[:4])
+		length := int64(binary.LittleEndian.Uint32(head[4:]))
+		// chunks are padded to an even size
+		size := 8 + length + length&1
+
+		switch {
+		case typ == "VP8X" && length == 10:
+			chunk := make([]byte, size)
+			if n, err := io.ReadFull(r, chunk); err != nil {
+				w.Write(chunk[:n])
+				return err
+			}
+			chunk[8] &^= webpFlagXMP
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		case typ == "EXIF" && length <= pngExifMaxSize:
+			chunk := make([]byte, size)
+			if n, err := io.ReadFull(r, chunk); err != nil {
+				w.Write(chunk[:n])
+				return err
+			}
+			// some writers keep the header of the jpeg segment
+			tiff := bytes.TrimPrefix(chunk[8:8+length], jpegExifHeader)
+			if mode == StripAll {
+				orientation := orientationTIFF(max(tiffOrientation(tiff), 1))
+				if len(orientation) > len(tiff) {
+					if err := writeJunk(w, r, chunk, 0); err != nil {
+						return err
+					}
+					continue
+				}
+				clear(tiff[copy(tiff, orientation):])
+			} else {
+				blankGPS(tiff)
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		case typ == "EXIF" || typ == "XMP ":
+			if err := writeJunk(w, r, head, size); err != nil {
+				return err
+			}
+		default:
+			if _, err := io.CopyN(w, r, size); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// writeJunk writes a zeroed JUNK chunk in place of the chunk with head,
+// the size bytes of the chunk not read yet are discarded from r first.
+func writeJunk(w io.Writer, r io.Reader, head []byte, size int64) error {
+	if _, err := io.CopyN(io.Discard, r, size); err != nil {
+		return err
+	}
+	length := int64(binary.LittleEndian.Uint32(head[4:8]))
+	io.WriteString(w, "JUNK")
+	w.Write(head[4:8])
+	_, err := io.CopyN(w, zeroReader{}, length+length&1)
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func writePNGChunk(w io.Writer, typ string, body []byte) error {
+	binary.Write(w, binary.BigEndian, uint32(len(body)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(body)
+	io.WriteString(w, typ)
+	w.Write(body)
+	return binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// tiffIFD0 returns the byte order and the offset of the first ifd of tiff.
+func tiffIFD0(tiff []byte) (binary.ByteOrder, int, bool) {
+	if len(tiff) < 8 {
+		return nil, 0, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	return order, int(order.Uint32(tiff[4:])), true
+}
+
+// tiffEntries calls f with the offset of every entry of the ifd at offset.
+func tiffEntries(tiff []byte, order binary.ByteOrder, offset int, f func(entry int)) bool {
+	if offset < 8 || offset+2 > len(tiff) {
+		return false
+	}
+	n := int(order.Uint16(tiff[offset:]))
+	if offset+2+n*12 > len(tiff) {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		f(offset + 2 + i*12)
+	}
+	return true
+}
+
+func tiffOrientation(tiff []byte) int {
+	order, ifd0, ok := tiffIFD0(tiff)
+	if !ok {
+		return 0
+	}
+	orientation := 0
+	tiffEntries(tiff, order, ifd0, func(entry int) {
+		if order.Uint16(tiff[entry:]) == tiffTagOrientation {
+			orientation = int(order.Uint16(tiff[entry+8:]))
+		}
+	})
+	return orientation
+}
+
+// setTIFFOrientation rewrites the orientation tag in place.
+func setTIFFOrientation(tiff []byte, orientation int) {
+	order, ifd0, ok := tiffIFD0(tiff)
+	if !ok {
+		return
+	}
+	tiffEntries(tiff, order, ifd0, func(entry int) {
+		if order.Uint16(tiff[entry:]) == tiffTagOrientation {
+			order.PutUint16(tiff[entry+8:], uint16(orientation))
+		}
+	})
+}
+
+// blankGPS zeroes the gps ifd of tiff in place and leaves it empty.
+func blankGPS(tiff []byte) {
+	order, ifd0, ok := tiffIFD0(tiff)
+	if !ok {
+		return
+	}
+
+	gpsIFD := 0
+	tiffEntries(tiff, order, ifd0, func(entry int) {
+		if order.Uint16(tiff[entry:]) == tiffTagGPSIFD {
+			gpsIFD = int(order.Uint32(tiff[entry+8:]))
+		}
+	})
+	if gpsIFD == 0 {
+		return
+	}
+
+	typeSizes := map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+	ok = tiffEntries(tiff, order, gpsIFD, func(entry int) {
+		size := typeSizes[order.Uint16(tiff[entry+2:])] * int(order.Uint32(tiff[entry+4:]))
+		if size > 4 {
+			valueOffset := int(order.Uint32(tiff[entry+8:]))
+			if valueOffset >= 8 && valueOffset+size <= len(tiff) {
+				clear(tiff[valueOffset : valueOffset+size])
+			}
+		}
+		clear(tiff[entry : entry+12])
+	})
+	if ok {
+		order.PutUint16(tiff[gpsIFD:], 0)
+	}
+}
+
+// orientationTIFF returns a tiff with only the orientation tag.
+func orientationTIFF(orientation int) []byte {
+	tiff := bytes.NewBuffer(nil)
+	tiff.WriteString("MM")
+	binary.Write(tiff, binary.BigEndian, uint16(42))
+	binary.Write(tiff, binary.BigEndian, uint32(8))
+	binary.Write(tiff, binary.BigEndian, uint16(1))
+	binary.Write(tiff, binary.BigEndian, uint16(tiffTagOrientation))
+	binary.Write(tiff, binary.BigEndian, uint16(3))
+	binary.Write(tiff, binary.BigEndian, uint32(1))
+	binary.Write(tiff, binary.BigEndian, uint16(orientation))
+	binary.Write(tiff, binary.BigEndian, uint16(0))
+	binary.Write(tiff, binary.BigEndian, uint32(0))
+	return tiff.Bytes()
+}
+
+// jpegExif returns the tiff data of the exif segment of jpeg data.
+func jpegExif(data []byte) []byte {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		if marker == 0xDA {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		payload := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(payload, jpegExifHeader) {
+			return append([]byte{}, payload[len(jpegExifHeader):]...)
+		}
+		pos += 2 + length
+	}
+	return nil
+}
+
+// insertJPEGExif adds an exif segment with tiff after the start of image.
+func insertJPEGExif(data []byte, tiff []byte) []byte {
+	if len(tiff) == 0 || !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) || len(jpegExifHeader)+len(tiff)+2 > 0xFFFF {
+		return data
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+len(tiff)+10))
+	out.Write(data[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(out, binary.BigEndian, uint16(len(jpegExifHeader)+len(tiff)+2))
+	out.Write(jpegExifHeader)
+	out.Write(tiff)
+	out.Write(data[2:])
+	return out.Bytes()
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"testing"
+)
+
+// testTIFF returns a big endian tiff with the orientation and a gps ifd
+// holding a latitude ref and a latitude.
+func testTIFF(orientation int) []byte {
+	b := &bytes.Buffer{}
+	be := binary.BigEndian
+	b.WriteString("MM")
+	binary.Write(b, be, uint16(42))
+	binary.Write(b, be, uint32(8))
+
+	// ifd0 at 8, the gps ifd at 38, the latitude at 68
+	binary.Write(b, be, uint16(2))
+	binary.Write(b, be, []uint16{tiffTagOrientation, 3})
+	binary.Write(b, be, uint32(1))
+	binary.Write(b, be, []uint16{uint16(orientation), 0})
+	binary.Write(b, be, []uint16{tiffTagGPSIFD, 4})
+	binary.Write(b, be, []uint32{1, 38})
+	binary.Write(b, be, uint32(0))
+
+	binary.Write(b, be, uint16(2))
+	binary.Write(b, be, []uint16{1, 2})
+	binary.Write(b, be, uint32(2))
+	b.WriteString("N\x00\x00\x00")
+	binary.Write(b, be, []uint16{2, 5})
+	binary.Write(b, be, []uint32{3, 68})
+	binary.Write(b, be, uint32(0))
+
+	binary.Write(b, be, []uint32{52, 1, 31, 1, 0, 1})
+	return b.Bytes()
+}
+
+func jpegSegment(marker byte, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(body)+2))
+	return append(seg, body...)
+}
+
+func pngChunk(typ string, body []byte) []byte {
+	b := &bytes.Buffer{}
+	writePNGChunk(b, typ, body)
+	return b.Bytes()
+}
+
+type testChunk struct {
+	typ  string
+	body []byte
+}
+
+// parsePNG splits data into chunks and checks their crc.
+func parsePNG(t *testing.T, data []byte) []testChunk {
+	t.Helper()
+	if !bytes.HasPrefix(data, pngSignature) {
+		t.Fatal("png signature is missing")
+	}
+	chunks := []testChunk{}
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+12 > len(data) {
+			t.Fatalf("truncated chunk at %d", pos)
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if end > len(data) {
+			t.Fatalf("truncated chunk at %d", pos)
+		}
+		if crc32.ChecksumIEEE(data[pos+4:end-4]) != binary.BigEndian.Uint32(data[end-4:]) {
+			t.Errorf("bad crc of %s", data[pos+4:pos+8])
+		}
+		chunks = append(chunks, testChunk{string(data[pos+4 : pos+8]), data[pos+8 : end-4]})
+		pos = end
+	}
+	return chunks
+}
+
+func strip(t *testing.T, data []byte, mode StripMode) ([]byte, error) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	err := stripMetadata(out, bytes.NewReader(data), mode)
+	return out.Bytes(), err
+}
+
+// checkBlankGPS checks that tiff keeps the orientation and has an empty gps ifd.
+func checkBlankGPS(t *testing.T, tiff []byte, orientation int) {
+	t.Helper()
+	if got := tiffOrientation(tiff); got != orientation {
+		t.Errorf("orientation = %d, want %d", got, orientation)
+	}
+	if n := binary.BigEndian.Uint16(tiff[38:]); n != 0 {
+		t.Errorf("gps ifd has %d entries", n)
+	}
+	if !bytes.Equal(tiff[40:92], make([]byte, 52)) {
+		t.Error("gps values are not blanked")
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	app0 := jpegSegment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+	xmp := jpegSegment(0xE1, jpegXMPHeader, []byte("<x:xmpmeta/>"))
+	com := jpegSegment(0xFE, []byte("a comment"))
+	scan := append(jpegSegment(0xDA, []byte{1, 2, 3}), 0x12, 0xFF, 0x00, 0xFF, 0xE1, 0x34, 0xFF, 0xD9)
+	build := func(orientation int) []byte {
+		exif := jpegSegment(0xE1, jpegExifHeader, testTIFF(orientation))
+		return bytes.Join([][]byte{{0xFF, 0xD8}, app0, exif, xmp, com, scan}, nil)
+	}
+
+	tests := []struct {
+		name        string
+		orientation int
+		mode        StripMode
+		exif        []byte
+		want        [][]byte
+	}{
+		{"location", 6, StripLocation, nil, [][]byte{app0, nil, com}},
+		{"all", 6, StripAll, orientationTIFF(6), [][]byte{app0, nil}},
+		{"all upright", 1, StripAll, nil, [][]byte{app0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := strip(t, build(tt.orientation), tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(got, []byte{0xFF, 0xD8}) || !bytes.HasSuffix(got, scan) {
+				t.Fatal("start of image or scan data changed")
+			}
+
+			segs := [][]byte{}
+			var tiff []byte
+			for pos := 2; pos < len(got)-len(scan); {
+				seg := got[pos : pos+2+int(binary.BigEndian.Uint16(got[pos+2:]))]
+				pos += len(seg)
+				if seg[1] == 0xE1 && bytes.HasPrefix(seg[4:], jpegExifHeader) {
+					// checked below, nil marks its position
+					tiff = seg[4+len(jpegExifHeader):]
+					seg = nil
+				}
+				segs = append(segs, seg)
+			}
+			if !reflect.DeepEqual(segs, tt.want) {
+				t.Errorf("segments = %q, want %q", segs, tt.want)
+			}
+
+			switch {
+			case tt.exif != nil:
+				if !bytes.Equal(tiff, tt.exif) {
+					t.Errorf("exif = %x, want %x", tiff, tt.exif)
+				}
+			case tt.mode == StripLocation:
+				checkBlankGPS(t, tiff, tt.orientation)
+			case tiff != nil:
+				t.Error("exif is not removed")
+			}
+		})
+	}
+}
+
+func TestStripUnchanged(t *testing.T) {
+	jpeg := bytes.Join([][]byte{{0xFF, 0xD8}, jpegSegment(0xE1, jpegExifHeader, testTIFF(6)), jpegSegment(0xDA, []byte{1}), {5, 6}}, nil)
+	truncated := jpeg[:20]
+	malformed := bytes.Join([][]byte{{0xFF, 0xD8, 0xFF, 0xFE, 0x00, 0x01}, jpegSegment(0xE1, jpegXMPHeader)}, nil)
+	noMarker := bytes.Join([][]byte{{0xFF, 0xD8, 0x00}, jpegSegment(0xE1, jpegXMPHeader)}, nil)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		mode    StripMode
+		wantErr bool
+	}{
+		{"keep", jpeg, StripNone, false},
+		{"text", []byte("hello, world"), StripAll, false},
+		{"empty", []byte{}, StripAll, false},
+		{"truncated jpeg", truncated, StripAll, true},
+		{"bad segment length", malformed, StripAll, false},
+		{"missing marker", noMarker, StripAll, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := strip(t, tt.data, tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("got %x, want %x", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	ihdr := pngChunk("IHDR", []byte{0, 0, 0, 1, 0, 0, 0, 1, 8, 6, 0, 0, 0})
+	xmp := pngChunk("iTXt", append(append([]byte{}, pngXMPKeyword...), "\x00\x00\x00<x:xmpmeta/>"...))
+	title := pngChunk("iTXt", []byte("Title\x00\x00\x00\x00\x00hello"))
+	text := pngChunk("tEXt", []byte("Comment\x00hi"))
+	idat := pngChunk("IDAT", []byte{1, 2, 3, 4})
+	iend := pngChunk("IEND", nil)
+	build := func(exif []byte) []byte {
+		return bytes.Join([][]byte{pngSignature, ihdr, pngChunk("eXIf", exif), xmp, title, text, idat, iend}, nil)
+	}
+
+	tests := []struct {
+		name  string
+		exif  []byte
+		mode  StripMode
+		types []string
+		want  []byte
+	}{
+		{"location", testTIFF(8), StripLocation, []string{"IHDR", "eXIf", "iTXt", "tEXt", "IDAT", "IEND"}, nil},
+		{"all", testTIFF(8), StripAll, []string{"IHDR", "eXIf", "IDAT", "IEND"}, orientationTIFF(8)},
+		{"all upright", testTIFF(1), StripAll, []string{"IHDR", "IDAT", "IEND"}, nil},
+		{"large exif", make([]byte, pngExifMaxSize+1), StripLocation, []string{"IHDR", "iTXt", "tEXt", "IDAT", "IEND"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := strip(t, build(tt.exif), tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			types := []string{}
+			for _, c := range parsePNG(t, got) {
+				types = append(types, c.typ)
+				switch {
+				case c.typ == "eXIf" && tt.want != nil:
+					if !bytes.Equal(c.body, tt.want) {
+						t.Errorf("exif = %x, want %x", c.body, tt.want)
+					}
+				case c.typ == "eXIf":
+					checkBlankGPS(t, c.body, 8)
+				case c.typ == "iTXt" && !bytes.Equal(c.body, title[8:len(title)-4]):
+					t.Error("xmp is not removed")
+				}
+			}
+			if !reflect.DeepEqual(types, tt.types) {
+				t.Errorf("chunks = %v, want %v", types, tt.types)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		data := build(testTIFF(1))
+		data = data[:len(data)-len(iend)-2]
+		got, err := strip(t, data, StripLocation)
+		if err == nil {
+			t.Error("no error for a truncated png")
+		}
+		if !bytes.HasSuffix(got, idat[:len(idat)-2]) {
+			t.Error("the data before the truncation is not copied")
+		}
+	})
+}
+
+func webpChunk(typ string, body []byte) []byte {
+	chunk := append([]byte(typ), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(body)))
+	chunk = append(chunk, body...)
+	if len(body)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// parseWebP splits data into chunks, the padding is left out.
+func parseWebP(t *testing.T, data []byte) []testChunk {
+	t.Helper()
+	if !isWebP(data) || int(binary.LittleEndian.Uint32(data[4:]))+8 != len(data) {
+		t.Fatal("bad riff header")
+	}
+	chunks := []testChunk{}
+	for pos := 12; pos < len(data); {
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if pos+8+length > len(data) {
+			t.Fatalf("truncated chunk at %d", pos)
+		}
+		chunks = append(chunks, testChunk{string(data[pos : pos+4]), data[pos+8 : pos+8+length]})
+		pos += 8 + length + length%2
+	}
+	return chunks
+}
+
+func TestStripWebP(t *testing.T) {
+	vp8l := webpChunk("VP8L", []byte{0x2F, 0, 0, 0, 0})
+	iccp := webpChunk("ICCP", []byte("profile"))
+	xmp := webpChunk("XMP ", []byte("<x:xmpmeta>gps</x:xmpmeta>!"))
+	build := func(exif []byte) []byte {
+		// the flags of icc, exif and xmp
+		vp8x := webpChunk("VP8X", []byte{0x2C, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+		body := bytes.Join([][]byte{webpHeader, vp8x, iccp, vp8l, webpChunk("EXIF", exif), xmp}, nil)
+		head := append([]byte{}, riffHeader...)
+		return append(binary.LittleEndian.AppendUint32(head, uint32(len(body))), body...)
+	}
+
+	tests := []struct {
+		name  string
+		exif  []byte
+		mode  StripMode
+		types []string
+		want  []byte
+	}{
+		{"location", testTIFF(3), StripLocation, []string{"VP8X", "ICCP", "VP8L", "EXIF", "JUNK"}, nil},
+		{"location with header", append(append([]byte{}, jpegExifHeader...), testTIFF(3)...), StripLocation, []string{"VP8X", "ICCP", "VP8L", "EXIF", "JUNK"}, nil},
+		{"all", testTIFF(3), StripAll, []string{"VP8X", "ICCP", "VP8L", "EXIF", "JUNK"}, orientationTIFF(3)},
+		{"all upright", testTIFF(1), StripAll, []string{"VP8X", "ICCP", "VP8L", "EXIF", "JUNK"}, orientationTIFF(1)},
+		{"all small exif", []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00\x00\x00\x00"), StripAll, []string{"VP8X", "ICCP", "VP8L", "JUNK", "JUNK"}, nil},
+		{"large exif", make([]byte, pngExifMaxSize+1), StripLocation, []string{"VP8X", "ICCP", "VP8L", "JUNK", "JUNK"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := build(tt.exif)
+			got, err := strip(t, data, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(data) {
+				t.Fatalf("size changed from %d to %d", len(data), len(got))
+			}
+
+			types := []string{}
+			for _, c := range parseWebP(t, got) {
+				types = append(types, c.typ)
+				switch c.typ {
+				case "VP8X":
+					if c.body[0] != 0x28 {
+						t.Errorf("flags = %#x, want the xmp flag cleared", c.body[0])
+					}
+				case "ICCP", "VP8L":
+					if !bytes.Contains(data, c.body) {
+						t.Errorf("%s changed", c.typ)
+					}
+				case "JUNK":
+					if !bytes.Equal(c.body, make([]byte, len(c.body))) {
+						t.Error("junk is not zeroed")
+					}
+				case "EXIF":
+					tiff := bytes.TrimPrefix(c.body, jpegExifHeader)
+					if tt.want == nil {
+						checkBlankGPS(t, tiff, 3)
+						break
+					}
+					if !bytes.HasPrefix(tiff, tt.want) || !bytes.Equal(tiff[len(tt.want):], make([]byte, len(tiff)-len(tt.want))) {
+						t.Errorf("exif = %x, want %x padded with zeros", tiff, tt.want)
+					}
+				}
+			}
+			if !reflect.DeepEqual(types, tt.types) {
+				t.Errorf("chunks = %v, want %v", types, tt.types)
+			}
+		})
+	}
+}
+
+func TestIsMetadataFree(t *testing.T) {
+	tests := map[string]bool{
+		"image/bmp":  true,
+		"text/plain": true,
+		"video/mp4":  true,
+		"image/tiff": false,
+		"image/heic": false,
+		"image/gif":  false,
+	}
+	for mimeType, want := range tests {
+		if got := isMetadataFree(mimeType); got != want {
+			t.Errorf("isMetadataFree(%q) = %v, want %v", mimeType, got, want)
+		}
+	}
+}
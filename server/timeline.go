@@ -0,0 +1,133 @@
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	groupYear  = "year"
+	groupMonth = "month"
+	groupDay   = "day"
+
+	defaultTimelinePageSize = 100
+	maxTimelinePageSize     = 1000
+)
+
+type TimelineBucket struct {
+	Key   string `json:"key"`
+	Year  int    `json:"year"`
+	Month int    `json:"month,omitempty"`
+	Day   int    `json:"day,omitempty"`
+	Count int    `json:"count"`
+}
+
+type Timeline struct {
+	Group    string            `json:"group"`
+	Buckets  []*TimelineBucket `json:"buckets"`
+	Bucket   string            `json:"bucket,omitempty"`
+	Total    int               `json:"total"`
+	Page     int               `json:"page"`
+	PageSize int               `json:"pageSize"`
+	Items    []*HTTPFileInfo   `json:"items"`
+}
+
+// Timeline groups the images and videos below path by capture time, the
+// mtime is used for files without one. The items are the newest first,
+// and can be limited to one bucket with the bucket query.
+func (s *Server) Timeline(e echo.Context, path string, fi fs.FileInfo) error {
+	dir, ok := s.index.rel(path)
+	if !ok {
+		return e.String(http.StatusNotFound, "file not found")
+	}
+
+	timeline := Timeline{
+		Group:    e.QueryParam("group"),
+		Bucket:   e.QueryParam("bucket"),
+		Page:     int(parseInt64Param(e, "page")),
+		PageSize: int(parseInt64Param(e, "pageSize")),
+		Buckets:  []*TimelineBucket{},
+		Items:    []*HTTPFileInfo{},
+	}
+	switch timeline.Group {
+	case groupYear, groupMonth, groupDay:
+	default:
+		timeline.Group = groupDay
+	}
+	if timeline.Page < 1 {
+		timeline.Page = 1
+	}
+	if timeline.PageSize < 1 {
+		timeline.PageSize = defaultTimelinePageSize
+	}
+	if timeline.PageSize > maxTimelinePageSize {
+		timeline.PageSize = maxTimelinePageSize
+	}
+
+	entries := []*IndexEntry{}
+	for _, entry := range s.index.Entries(dir) {
+		if entry.IsDir || !(strings.HasPrefix(entry.MimeType, "image/") || strings.HasPrefix(entry.MimeType, "video/")) {
+			continue
+		}
+		if entry.CaptureTime == 0 {
+			entry.CaptureTime = entry.ModTime
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i int, j int) bool {
+		if entries[i].CaptureTime != entries[j].CaptureTime {
+			return entries[i].CaptureTime > entries[j].CaptureTime
+		}
+		return entries[i].Path < entries[j].Path
+	})
+
+	items := []*IndexEntry{}
+	buckets := map[string]*TimelineBucket{}
+	for _, entry := range entries {
+		bucket := timelineBucket(entry.CaptureTime, timeline.Group)
+		if b, ok := buckets[bucket.Key]; ok {
+			b.Count++
+		} else {
+			bucket.Count = 1
+			buckets[bucket.Key] = bucket
+			timeline.Buckets = append(timeline.Buckets, bucket)
+		}
+		day := timelineBucket(entry.CaptureTime, groupDay).Key
+		if timeline.Bucket == "" || day == timeline.Bucket || strings.HasPrefix(day, timeline.Bucket+"-") {
+			items = append(items, entry)
+		}
+	}
+
+	timeline.Total = len(items)
+	// pages after the last are empty, checked before multiplying so a large
+	// page can't overflow
+	start := len(items)
+	if timeline.Page-1 <= len(items)/timeline.PageSize {
+		start = (timeline.Page - 1) * timeline.PageSize
+	}
+	end := min(start+timeline.PageSize, len(items))
+	for i := start; i < end; i++ {
+		info := s.convertIndexEntry(items[i])
+		info.CaptureTime = items[i].CaptureTime
+		timeline.Items = append(timeline.Items, info)
+	}
+
+	return e.JSON(http.StatusOK, &timeline)
+}
+
+func timelineBucket(unix int64, group string) *TimelineBucket {
+	t := time.Unix(unix, 0)
+	switch group {
+	case groupYear:
+		return &TimelineBucket{Key: t.Format("2006"), Year: t.Year()}
+	case groupMonth:
+		return &TimelineBucket{Key: t.Format("2006-01"), Year: t.Year(), Month: int(t.Month())}
+	default:
+		return &TimelineBucket{Key: t.Format(time.DateOnly), Year: t.Year(), Month: int(t.Month()), Day: t.Day()}
+	}
+}
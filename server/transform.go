@@ -2,21 +2,26 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"io"
 	"mama/config"
 	"mama/log"
 	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/nao1215/imaging"
@@ -26,45 +31,123 @@ import (
 
 const (
 	urlQueryParamKey      = "t"
+	urlQueryPresetKey     = "p"
 	urlQueryParamSep      = "|"
 	urlQueryParamValueSep = ","
 
 	opResize    = "resize"
 	opThumbnail = "thumbnail"
 	opSnapshot  = "snapshot"
+	opCrop      = "crop"
+	opRotate    = "rotate"
+	opFlip      = "flip"
+
+	opBlur       = "blur"
+	opSharpen    = "sharpen"
+	opGrayscale  = "grayscale"
+	opGamma      = "gamma"
+	opContrast   = "contrast"
+	opBrightness = "brightness"
+	opSaturation = "saturation"
+
+	fitInside  = "inside"
+	fitContain = "contain"
+	fitCover   = "cover"
+	fitFill    = "fill"
+
+	flipH  = "h"
+	flipV  = "v"
+	flipHV = "hv"
+
+	// the largest width or height of a jpeg
+	maxImageDimension = 65535
 
 	defaultQuality = 95
 	defaultFormat  = Format("png")
+	formatAuto     = "auto"
 )
 
 type Transform struct {
-	cacheDir string
-	ops      map[string]*TransformDef
+	cache *TransformCache
+	ops   map[string]*TransformDef
+
+	workers      chan struct{}
+	queueTimeout time.Duration
+	flights      map[string]*transformFlight
+	flightsMu    sync.Mutex
 }
 
 type TransformFunc func(*TransformOp, *log.Log) error
 type TransformDef struct {
 	f           TransformFunc
 	canFallback bool
+	validate    func(*TransformOp) error
 }
 
-func NewTransform(cacheDir string) *Transform {
-	os.MkdirAll(cacheDir, os.ModePerm)
+func NewTransform(cache *TransformCache, workers int, queueTimeout time.Duration) *Transform {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
 	return &Transform{
-		cacheDir: cacheDir,
+		cache:        cache,
+		workers:      make(chan struct{}, workers),
+		queueTimeout: queueTimeout,
+		flights:      map[string]*transformFlight{},
 		ops: map[string]*TransformDef{
-			opResize:    {f: transformResize, canFallback: true},
+			opResize:    {f: transformResize, canFallback: true, validate: validateResize},
 			opThumbnail: {f: transformThumbnail, canFallback: true},
 			opSnapshot:  {f: transfomrSnapshot, canFallback: false},
+			opSprite:    {f: transformSprite, canFallback: false},
+			opCrop:      {f: transformCrop, canFallback: true},
+			opRotate:    {f: transformRotate, canFallback: true},
+			opFlip:      {f: transformFlip, canFallback: true},
+			opWatermark: {f: transformWatermark, canFallback: true, validate: validateWatermark},
+
+			opBlur:       {f: transformAdjust(imaging.Blur), canFallback: true, validate: valueRange(0, 100, false)},
+			opSharpen:    {f: transformAdjust(imaging.Sharpen), canFallback: true, validate: valueRange(0, 100, false)},
+			opGrayscale:  {f: transformAdjust(grayscale), canFallback: true},
+			opGamma:      {f: transformAdjust(imaging.AdjustGamma), canFallback: true, validate: valueRange(0, 10, false)},
+			opContrast:   {f: transformAdjust(imaging.AdjustContrast), canFallback: true, validate: valueRange(-100, 100, true)},
+			opBrightness: {f: transformAdjust(imaging.AdjustBrightness), canFallback: true, validate: valueRange(-100, 100, true)},
+			opSaturation: {f: transformAdjust(imaging.AdjustSaturation), canFallback: true, validate: valueRange(-100, 500, true)},
 		},
 	}
 }
 
+// transformResize resizes to w x h by fit, contain, cover and fill never
+// enlarge the image unless op.enlarge is set.
 func transformResize(op *TransformOp, log *log.Log) error {
-	log.Infof("start resize with params: w=%d h=%d format=%s quality=%d", op.w, op.h, op.format, op.quality)
+	log.Infof("start resize with params: w=%d h=%d fit=%s enlarge=%t format=%s quality=%d", op.w, op.h, op.fit, op.enlarge, op.format, op.quality)
 	return transformImage(op, log, func(img image.Image) (image.Image, error) {
+		if op.w == 0 && op.h == 0 {
+			log.Warn("width and height is zero, return source image")
+			return img, nil
+		}
+
+		if op.fit == fitContain || op.fit == fitCover || op.fit == fitFill {
+			w, h := op.w, op.h
+			if !op.enlarge {
+				w, h = imageShrinkBox(img, w, h)
+			}
+			// the missing side keeps the ratio of the image
+			rw, rh := w, h
+			if rw == 0 || rh == 0 {
+				rw, rh = imageRatioSize(img, w, h)
+			}
+			if err := checkOutputSize(op, rw, rh); err != nil {
+				return nil, err
+			}
 
-		//always keep the ratio
+			switch {
+			case op.fit == fitContain && w > 0 && h > 0:
+				return imageContain(img, w, h, op.bgColor()), nil
+			case op.fit == fitCover && w > 0 && h > 0:
+				return imaging.Fill(img, w, h, op.anchor(), imaging.Lanczos), nil
+			}
+			return imaging.Resize(img, w, h, imaging.Lanczos), nil
+		}
+
+		//always keep the ratio and never enlarge
 		dw := op.w
 		dh := op.h
 		if dw > 0 && dh > 0 {
@@ -82,22 +165,133 @@ func transformResize(op *TransformOp, log *log.Log) error {
 func transformThumbnail(op *TransformOp, log *log.Log) error {
 	log.Infof("start resize with params: w=%d h=%d format=%s quality=%d", op.w, op.h, op.format, op.quality)
 	return transformImage(op, log, func(img image.Image) (image.Image, error) {
+		if op.w == 0 && op.h == 0 {
+			log.Warn("width and height is zero, return source image")
+			return img, nil
+		}
 		return imageScale(img, op.w, op.h, imaging.Thumbnail), nil
 	})
 }
 
+// validateResize rejects the sizes over the megapixel limit before any
+// image is decoded.
+func validateResize(op *TransformOp) error {
+	if op.w > 0 && op.h > 0 {
+		return checkOutputSize(op, op.w, op.h)
+	}
+	return nil
+}
+
+// checkOutputSize checks an image of width x height to be allocated by op
+// against the megapixel limit of the inputs.
+func checkOutputSize(op *TransformOp, width int, height int) error {
+	if maxPixels := config.C.Transform.MaxMegapixels * 1e6; maxPixels > 0 && float64(width)*float64(height) > maxPixels {
+		return invalidParam(op.op, "", "output %dx%d is larger than %g megapixels", width, height, config.C.Transform.MaxMegapixels)
+	}
+	return nil
+}
+
+// transformCrop crops the rect at x,y with the size w x h, or the area of
+// w x h at gravity. A zero size means the rest of the image.
+func transformCrop(op *TransformOp, log *log.Log) error {
+	log.Infof("start crop with params: x=%d y=%d w=%d h=%d gravity=%s format=%s", op.x, op.y, op.w, op.h, op.gravity, op.format)
+	return transformImage(op, log, func(img image.Image) (image.Image, error) {
+		width, height := imageSize(img)
+		w, h := op.w, op.h
+		if w <= 0 {
+			w = width - op.x
+		}
+		if h <= 0 {
+			h = height - op.y
+		}
+
+		var result *image.NRGBA
+		if op.gravity != "" {
+			result = imaging.CropAnchor(img, w, h, op.anchor())
+		} else {
+			result = imaging.Crop(img, image.Rect(op.x, op.y, op.x+w, op.y+h))
+		}
+		if result.Bounds().Empty() {
+			return nil, invalidParam(op.op, "", "crop area is out of the image %dx%d", width, height)
+		}
+		return result, nil
+	})
+}
+
+// transformRotate rotates clockwise by angle degrees.
+func transformRotate(op *TransformOp, log *log.Log) error {
+	log.Infof("start rotate with params: angle=%g bg=%s format=%s", op.angle, op.bg, op.format)
+	return transformImage(op, log, func(img image.Image) (image.Image, error) {
+		return imageRotate(img, op.angle, op.bgColor()), nil
+	})
+}
+
+// transformAdjust applies a filter of imaging with the value of op, which
+// is the sigma of blur and sharpen, the gamma, or the percentage of the
+// other adjustments.
+func transformAdjust(adjust func(image.Image, float64) *image.NRGBA) TransformFunc {
+	return func(op *TransformOp, log *log.Log) error {
+		log.Infof("start %s with params: v=%g format=%s quality=%d", op.op, op.value, op.format, op.quality)
+		return transformImage(op, log, func(img image.Image) (image.Image, error) {
+			return adjust(img, op.value), nil
+		})
+	}
+}
+
+func grayscale(img image.Image, _ float64) *image.NRGBA {
+	return imaging.Grayscale(img)
+}
+
+// valueRange checks the value of op is in (lo, hi], or [lo, hi] if
+// minInclusive.
+func valueRange(lo float64, hi float64, minInclusive bool) func(*TransformOp) error {
+	return func(op *TransformOp) error {
+		if op.value > hi || op.value < lo || (op.value == lo && !minInclusive) {
+			if minInclusive {
+				return fmt.Errorf("%s value should be in [%g, %g]", op.op, lo, hi)
+			}
+			return fmt.Errorf("%s value should be in (%g, %g]", op.op, lo, hi)
+		}
+		return nil
+	}
+}
+
+func transformFlip(op *TransformOp, log *log.Log) error {
+	log.Infof("start flip with params: dir=%s format=%s", op.dir, op.format)
+	return transformImage(op, log, func(img image.Image) (image.Image, error) {
+		switch op.dir {
+		case flipV:
+			return imaging.FlipV(img), nil
+		case flipHV:
+			return imaging.Rotate180(img), nil
+		default:
+			return imaging.FlipH(img), nil
+		}
+	})
+}
+
 func transfomrSnapshot(op *TransformOp, log *log.Log) error {
-	imgBytes, err := vedioSnapshot(op.file.path, op.framenum)
+	var (
+		imgBytes []byte
+		err      error
+	)
+	if op.hasTime {
+		log.Infof("start snapshot with params: time=%g format=%s", op.time, op.format)
+		imgBytes, err = videoSnapshotAt(op.ctx, op.file.path, op.time)
+	} else {
+		log.Infof("start snapshot with params: framenum=%d format=%s", op.framenum, op.format)
+		imgBytes, err = vedioSnapshot(op.ctx, op.file.path, op.framenum)
+	}
 	if err != nil {
 		return err
 	}
 
-	img, err := imageDecode(bytes.NewReader(imgBytes))
+	img, err := imageDecodeBytes(op.ctx, imgBytes)
 	if err != nil {
 		return err
 	}
 
-	result, err := imageToBytes(img, Format(op.format), op.quality)
+	result, err := imageToBytes(img, Format(op.format), op.quality, op.lossless)
 	if err != nil {
 		return err
 	}
@@ -107,25 +301,32 @@ func transfomrSnapshot(op *TransformOp, log *log.Log) error {
 	return nil
 }
 
+// transformImage decodes the result of the previous op, or the source file
+// for the first op.
 func transformImage(op *TransformOp, log *log.Log, f func(image.Image) (image.Image, error)) error {
-	img, err := imageDecodeBytes(op.source)
+	var (
+		img image.Image
+		err error
+	)
+	if op.source != nil {
+		img, err = imageDecodeBytes(op.ctx, op.source)
+	} else {
+		img, err = op.file.decode(op.ctx)
+	}
 	if err != nil {
 		log.Errorf("decode image fail: %v", err)
 		return err
 	}
 
-	var resultImg image.Image
-	if op.w == 0 && op.h == 0 {
-		log.Warn("width and height is zero, return source image")
-		resultImg = img
-	} else {
-		resultImg, err = f(img)
-		if err != nil {
-			return err
-		}
+	resultImg, err := f(img)
+	if err != nil {
+		return err
+	}
+	if err := op.ctx.Err(); err != nil {
+		return err
 	}
 
-	result, err := imageToBytes(resultImg, Format(op.format), op.quality)
+	result, err := imageToBytes(resultImg, Format(op.format), op.quality, op.lossless)
 	if err != nil {
 		return err
 	}
@@ -135,38 +336,77 @@ func transformImage(op *TransformOp, log *log.Log, f func(image.Image) (image.Im
 	return nil
 }
 
+// TransformInputFile is the source of a task, it is read on demand since
+// it may be a large video.
 type TransformInputFile struct {
 	path string
 	mu   sync.Mutex
 
-	info os.FileInfo
-	file []byte
+	info     os.FileInfo
+	mimeType string
 }
 
-func (f *TransformInputFile) getFileInfo() (os.FileInfo, []byte, error) {
+func (f *TransformInputFile) stat() (os.FileInfo, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	if f.info != nil && f.file != nil {
-		return f.info, f.file, nil
+	if f.info != nil {
+		return f.info, nil
 	}
 
 	var err error
-
 	f.info, err = os.Stat(f.path)
+	return f.info, err
+}
+
+// detectMimeType sniffs the mime type from the head of the file.
+func (f *TransformInputFile) detectMimeType() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.mimeType != "" {
+		return f.mimeType, nil
+	}
+
+	file, err := os.Open(f.path)
 	if err != nil {
-		return nil, nil, err
+		return "", err
 	}
+	defer file.Close()
+
+	mtype, err := mimetype.DetectReader(file)
+	if err != nil {
+		return "", err
+	}
+	f.mimeType = mtype.String()
+	return f.mimeType, nil
+}
+
+// head returns at most the first n bytes of the file.
+func (f *TransformInputFile) head(n int64) ([]byte, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(io.LimitReader(file, n))
+}
 
-	f.file, err = os.ReadFile(f.path)
+// decode decodes the image from the file without reading it into memory.
+func (f *TransformInputFile) decode(ctx context.Context) (image.Image, error) {
+	file, err := os.Open(f.path)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	defer file.Close()
 
-	return f.info, f.file, nil
+	return imageDecode(&contextReader{ctx: ctx, ReadSeeker: file})
 }
 
 type TransformOp struct {
+	// canceled once all the requests of the task are gone
+	ctx    context.Context
 	file   *TransformInputFile
 	source []byte
 	result []byte
@@ -174,9 +414,49 @@ type TransformOp struct {
 	op       string
 	w        int
 	h        int
+	x        int
+	y        int
+	gravity  string
+	angle    float64
+	dir      string
+	fit      string
+	bg       string
+	value    float64
+	name     string
+	opacity  float64 // negative if not given
+	scale    float64
+	margin   int
+	version  string
 	quality  int
 	format   Format
+	auto     bool
+	lossless bool
+	enlarge  bool
 	framenum int
+	time     float64
+	hasTime  bool
+	count    int
+	cols     int
+	vtt      string
+}
+
+func (op *TransformOp) anchor() imaging.Anchor {
+	if anchor, ok := Anchors[op.gravity]; ok {
+		return anchor
+	}
+	return imaging.Center
+}
+
+// bgColor returns the background color, which is transparent by default
+// except for jpeg.
+func (op *TransformOp) bgColor() color.Color {
+	if c, ok := parseColor(op.bg); ok {
+		return c
+	}
+	if op.format == JPEG {
+		return color.White
+	}
+	return color.Transparent
 }
 
 type TransformTask struct {
@@ -186,51 +466,114 @@ type TransformTask struct {
 	cachePath string
 	ops       []*TransformOp
 	force     bool
+	keepMeta  bool
+	strip     StripMode
+	strict    bool
+	err       *TransformError
+	vary      bool
 	inputFile *TransformInputFile
 	result    []byte
 }
 
 func (t *Transform) Do(ctx echo.Context, path string) error {
 	task := t.getTask(ctx, path)
-	if task != nil {
-		if !task.force && tryCache(task) == nil {
+	if task.err != nil && (task.strict || !t.canFallback(task)) {
+		return writeTransformError(ctx, task.err)
+	}
+
+	// the chain is not run if an op or a param was rejected, its result
+	// would be cached under the key of the full chain
+	if task.err == nil && len(task.ops) > 0 {
+		if !task.force && t.tryCache(task) == nil {
 			task.log.Infof("return cached file %s", task.cachePath)
 			return nil
 		}
 
-		if err := t.runTask(task); err == nil {
+		err := t.execute(task)
+		var transformErr *TransformError
+		switch {
+		case err == nil:
 			task.log.Info("task finish ok")
-			if err := saveCache(task); err == nil {
-				if err := serveFile(task.ctx, task.cachePath); err == nil {
-					return nil
-				}
+			if err := serveFile(task.ctx, task.cachePath, task.contentType()); err == nil {
+				return nil
 			}
-		} else {
+		case errors.Is(err, errQueueTimeout):
+			task.log.Warnf("task fail: %s", err.Error())
+			ctx.Response().Header().Set(echo.HeaderRetryAfter, "1")
+			return writeTransformError(ctx, &TransformError{Status: http.StatusServiceUnavailable, Code: errCodeUnavailable, Message: err.Error()})
+		case ctx.Request().Context().Err() != nil:
+			task.log.Infof("client gone: %s", err.Error())
+			return nil
+		case errors.As(err, &transformErr):
 			task.log.Errorf("task fail: %s", err.Error())
+			task.err = transformErr
+		default:
+			task.log.Errorf("task fail: %s", err.Error())
+			task.err = &TransformError{Status: http.StatusInternalServerError, Code: errCodeFailed, Message: err.Error()}
+		}
+
+		if task.err != nil && (task.strict || !t.canFallback(task)) {
+			return writeTransformError(ctx, task.err)
 		}
 	}
 
+	if task.err != nil {
+		ctx.Response().Header().Set(headerTransformFallback, task.err.Code)
+	}
 	return fallback(task)
 
 }
 
-func (t *Transform) runTask(task *TransformTask) error {
+// canFallback reports whether the original file can be returned when the
+// ops of task fail, e.g. a video can't be returned for a snapshot.
+func (t *Transform) canFallback(task *TransformTask) bool {
+	if task.err != nil {
+		if op, ok := t.ops[task.err.Op]; ok && !op.canFallback {
+			return false
+		}
+	}
+	for _, op := range task.ops {
+		if !t.ops[op.op].canFallback {
+			return false
+		}
+	}
+	return true
+}
 
-	var (
-		lastOp    *TransformOp
-		lastOpErr error
-	)
+func (t *Transform) runTask(ctx context.Context, task *TransformTask) error {
+
+	var lastOp *TransformOp
 
 	for _, op := range task.ops {
-		if lastOp == nil {
-			op.source = task.inputFile.file
-		} else {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		op.ctx = ctx
+		// the first op reads the source file by itself, only if needed
+		if lastOp != nil {
 			op.source = lastOp.result
 		}
 
 		opDef := t.ops[op.op]
-		if lastOpErr = opDef.f(op, task.log.WithNewPrefix(fmt.Sprintf("transform %s %s", task.inputFile.path, op.op))); lastOpErr != nil {
-			break
+		if err := opDef.f(op, task.log.WithNewPrefix(fmt.Sprintf("transform %s %s", task.inputFile.path, op.op))); err != nil {
+			// never save the result of a partial chain
+			task.result = nil
+			var transformErr *TransformError
+			if errors.As(err, &transformErr) {
+				if transformErr.Op == "" {
+					transformErr.Op = op.op
+				}
+				return transformErr
+			}
+			if errors.Is(err, ErrImageTooLarge) {
+				return &TransformError{Status: http.StatusUnprocessableEntity, Code: errCodeTooLarge, Message: err.Error(), Op: op.op}
+			}
+			if errors.Is(err, image.ErrFormat) {
+				transformErr := unsupportedSource("%v", err)
+				transformErr.Op = op.op
+				return transformErr
+			}
+			return &TransformError{Status: http.StatusInternalServerError, Code: errCodeFailed, Message: err.Error(), Op: op.op}
 		}
 
 		task.result = op.result
@@ -243,12 +586,40 @@ func (t *Transform) runTask(task *TransformTask) error {
 func (t *Transform) getTask(ctx echo.Context, path string) *TransformTask {
 	task := &TransformTask{
 		ctx:       ctx,
+		strict:    config.C.Transform.Strict || isFlagSet(ctx, "strict"),
+		strip:     stripModeOf(getRelSlashPath(path), ctx.QueryParam("strip")),
 		log:       log.L.WithNewPrefix("transform " + path),
 		inputFile: &TransformInputFile{path: path},
 		ops:       []*TransformOp{},
 	}
 
 	param := ctx.QueryParam(urlQueryParamKey)
+	if param != "" && config.C.Transform.PresetsOnly {
+		task.log.Warnf("ignore param %s, only presets are allowed", param)
+		task.setErr(&TransformError{Status: http.StatusForbidden, Code: errCodeForbidden, Message: "only presets are allowed", Param: urlQueryParamKey})
+		param = ""
+	}
+	if param != "" && config.C.Transform.Secret != "" {
+		if err := verifySign(getRelSlashPath(path), param, ctx.QueryParam(urlQueryExpireKey), ctx.QueryParam(urlQuerySignKey)); err != nil {
+			task.log.Warnf("ignore param %s: %v", param, err)
+			task.setErr(&TransformError{Status: http.StatusForbidden, Code: errCodeForbidden, Message: err.Error(), Param: urlQuerySignKey})
+			param = ""
+		}
+	}
+	if name := ctx.QueryParam(urlQueryPresetKey); name != "" {
+		preset, ok := config.C.Transform.Presets[name]
+		if !ok {
+			task.log.Warnf("preset %s not found", name)
+			task.setErr(invalidParam("", urlQueryPresetKey, "preset %s not found", name))
+			return task
+		}
+		// the ops of t are applied after the preset, the key is made of
+		// the ops so changing a preset doesn't return the old results
+		if param != "" {
+			preset += urlQueryParamSep + param
+		}
+		param = preset
+	}
 	if param == "" {
 		return task
 	}
@@ -267,75 +638,80 @@ func (t *Transform) getTask(ctx echo.Context, path string) *TransformTask {
 		opt := TransformOp{
 			file:    task.inputFile,
 			quality: defaultQuality,
+			opacity: -1,
 		}
 
 		items := strings.Split(optStr, urlQueryParamValueSep)
 		for _, item := range items {
-			if kv := strings.SplitN(item, "=", 2); len(kv) > 0 {
-				k := kv[0]
-				v := ""
-				if len(kv) > 1 {
-					v = kv[1]
-				}
-
-				switch k {
-				case "op":
-					if _, ok := t.ops[v]; ok {
-						opt.op = v
-					} else {
-						break
-					}
-				case "w":
-					if vInt, err := strconv.ParseInt(v, 10, 32); err == nil {
-						opt.w = int(vInt)
-					}
-				case "h":
-					if vInt, err := strconv.ParseInt(v, 10, 32); err == nil {
-						opt.h = int(vInt)
-					}
-				case "q":
-					if vInt, err := strconv.ParseInt(v, 10, 32); err == nil {
-						opt.quality = int(vInt)
-					}
-				case "fmt":
-					//TODO check
-					if format, ok := FormatMap[v]; ok {
-						opt.format = format
-					}
-				case "framenum":
-					if vInt, err := strconv.ParseInt(v, 10, 32); err == nil {
-						opt.framenum = int(vInt)
-					}
-				case "force":
-					task.force = task.force || v != "false"
-				}
+			if item == "" {
+				continue
+			}
+			kv := strings.SplitN(item, "=", 2)
+			k := kv[0]
+			v := ""
+			if len(kv) > 1 {
+				v = kv[1]
+			}
+			if err := t.parseOpParam(task, &opt, k, v); err != nil {
+				task.log.Warnf("ignore param %s: %v", item, err)
+				task.setErr(err)
 			}
 		}
 
 		if opt.op == "" {
 			continue
 		}
+		if validate := t.ops[opt.op].validate; validate != nil {
+			if err := validate(&opt); err != nil {
+				task.log.Warnf("skip op %s: %v", opt.op, err)
+				task.setErr(invalidParam(opt.op, "", "%v", err))
+				continue
+			}
+		}
 
+		if opt.format == WEBP && !opt.lossless && !webpLossySupported {
+			task.log.Warnf("skip op %s: lossy webp is not supported", opt.op)
+			task.setErr(invalidParam(opt.op, "fmt", "lossy webp is not supported by this build, add lossless=1"))
+			continue
+		}
 		if opt.format == "" {
-			if _, file, err := task.inputFile.getFileInfo(); err == nil {
-				if mtype, err := mimetype.DetectReader(bytes.NewReader(file)); err == nil {
-					if format, ok := MimeTypeToFormat[mtype.String()]; ok {
-						task.log.Infof("set op %s format to %s by mimetype %s", opt.op, format, mtype.String())
-						opt.format = format
-					}
+			if mtype, err := task.inputFile.detectMimeType(); err == nil {
+				if format, ok := MimeTypeToFormat[mtype]; ok {
+					task.log.Infof("set op %s format to %s by mimetype %s", opt.op, format, mtype)
+					opt.format = format
 				}
 			}
 		}
+		if opt.format == WEBP && !webpLossySupported {
+			// webp sources are kept as webp
+			opt.lossless = true
+		}
+		if opt.format == "" && opt.op == opSprite {
+			// sprites of many frames are too large as png
+			opt.format = JPEG
+		}
 		if opt.format == "" {
 			task.log.Infof("set op %s format %s by default", opt.op, defaultFormat)
 			opt.format = defaultFormat
 		}
+		if opt.auto {
+			opt.format = negotiateFormat(ctx.Request().Header.Get(echo.HeaderAccept), opt.format)
+			task.log.Infof("set op %s format to %s by accept header", opt.op, opt.format)
+			task.vary = true
+		}
 
 		if opt.op == opSnapshot {
 			if opt.framenum < 1 {
 				opt.framenum = 1
 			}
 		}
+		if opt.op == opSprite {
+			if opt.w > maxSpriteWidth || opt.h > maxSpriteWidth {
+				task.log.Warnf("skip op %s: tile size is larger than %d", opt.op, maxSpriteWidth)
+				task.setErr(invalidParam(opt.op, "w", "tile size should not be larger than %d", maxSpriteWidth))
+				continue
+			}
+		}
 
 		task.log.Infof("add op %s", opt.op)
 		task.ops = append(task.ops, &opt)
@@ -343,37 +719,272 @@ func (t *Transform) getTask(ctx echo.Context, path string) *TransformTask {
 	}
 
 	if len(task.ops) == 0 {
-		return nil
+		return task
+	}
+
+	if task.vary {
+		// the response differs by the accept header even if the negotiated
+		// format is the same as the source
+		ctx.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	}
+
+	if task.keepMeta {
+		keys = append(keys, "meta="+StripModeNames[task.strip])
+	}
+
+	if lastOp := task.ops[len(task.ops)-1]; lastOp.op == opSprite && isFlagSet(ctx, spriteVTTKey) {
+		lastOp.vtt = spriteVTTURL(filepath.Base(path), ctx.QueryParams())
+		keys = append(keys, spriteVTTKey+"="+lastOp.vtt)
 	}
 
-	task.key = getKey(path, keys)
-	task.cachePath = filepath.Join(t.cacheDir, task.key)
+	info, err := task.inputFile.stat()
+	if err != nil {
+		task.log.Warnf("stat source fail: %v", err)
+		task.setErr(&TransformError{Status: http.StatusInternalServerError, Code: errCodeFailed, Message: err.Error()})
+		task.ops = nil
+		return task
+	}
+
+	task.key = getKey(path, info, keys)
+	task.cachePath = t.cache.Path(task.key)
 
 	return task
 }
 
-func tryCache(task *TransformTask) error {
-	return serveFile(task.ctx, task.cachePath)
+// maxImageSide is the largest width or height of an image, which is limited
+// by the megapixels of the inputs and by the formats.
+func maxImageSide() int64 {
+	side := int64(maxImageDimension)
+	if maxPixels := int64(config.C.Transform.MaxMegapixels * 1e6); maxPixels > 0 {
+		side = min(side, maxPixels)
+	}
+	return side
 }
 
-func saveCache(task *TransformTask) error {
+// parseOpParam sets the param k of opt to v.
+func (t *Transform) parseOpParam(task *TransformTask, opt *TransformOp, k string, v string) *TransformError {
+	parseInt := func(lo int64, hi int64) (int, *TransformError) {
+		vInt, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || vInt < lo || vInt > hi {
+			return 0, invalidParam(opt.op, k, "%s should be an integer in [%d, %d]", k, lo, hi)
+		}
+		return int(vInt), nil
+	}
+	parseFloat := func(lo float64, hi float64) (float64, *TransformError) {
+		vFloat, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(vFloat) || vFloat < lo || vFloat > hi {
+			return 0, invalidParam(opt.op, k, "%s should be a number in [%g, %g]", k, lo, hi)
+		}
+		return vFloat, nil
+	}
+
+	var err *TransformError
+	switch k {
+	case "op":
+		if _, ok := t.ops[v]; !ok {
+			return &TransformError{Status: http.StatusBadRequest, Code: errCodeUnknownOp, Message: fmt.Sprintf("unknown op %q", v), Op: v, Param: k}
+		}
+		opt.op = v
+	case "w":
+		opt.w, err = parseInt(0, maxImageSide())
+	case "h":
+		opt.h, err = parseInt(0, maxImageSide())
+	case "x":
+		opt.x, err = parseInt(0, maxImageSide())
+	case "y":
+		opt.y, err = parseInt(0, maxImageSide())
+	case "gravity":
+		if _, ok := Anchors[v]; !ok {
+			return invalidParam(opt.op, k, "unknown gravity %q", v)
+		}
+		opt.gravity = v
+	case "angle":
+		var angle float64
+		if angle, err = parseFloat(-360, 360); err == nil {
+			opt.angle = math.Mod(angle+360, 360)
+		}
+	case "dir":
+		if v != flipH && v != flipV && v != flipHV {
+			return invalidParam(opt.op, k, "dir should be h, v or hv")
+		}
+		opt.dir = v
+	case "fit":
+		if v != fitInside && v != fitContain && v != fitCover && v != fitFill {
+			return invalidParam(opt.op, k, "fit should be inside, contain, cover or fill")
+		}
+		opt.fit = v
+	case "bg":
+		if _, ok := parseColor(v); !ok {
+			return invalidParam(opt.op, k, "bg should be a hex color")
+		}
+		opt.bg = strings.TrimPrefix(strings.ToLower(v), "#")
+	case "v":
+		opt.value, err = parseFloat(-math.MaxFloat64, math.MaxFloat64)
+	case "name":
+		opt.name = v
+	case "opacity":
+		opt.opacity, err = parseFloat(0, 1)
+	case "scale":
+		opt.scale, err = parseFloat(0, 1)
+	case "margin":
+		opt.margin, err = parseInt(0, maxImageSide())
+	case "q":
+		opt.quality, err = parseInt(1, 100)
+	case "fmt":
+		if v == formatAuto {
+			opt.auto = true
+		} else if format, ok := FormatMap[v]; ok {
+			opt.format = format
+		} else {
+			return invalidParam(opt.op, k, "unknown format %q", v)
+		}
+	case "lossless":
+		opt.lossless = v != "false" && v != "0"
+	case "enlarge":
+		opt.enlarge = v != "false" && v != "0"
+	case "framenum":
+		opt.framenum, err = parseInt(0, math.MaxInt32)
+	case "time":
+		var ok bool
+		if opt.time, ok = parseVideoTime(v); !ok {
+			return invalidParam(opt.op, k, "time should be seconds or hh:mm:ss")
+		}
+		opt.hasTime = true
+	case "n":
+		opt.count, err = parseInt(1, maxSpriteCount)
+	case "cols":
+		opt.cols, err = parseInt(1, maxSpriteCount)
+	case "force":
+		task.force = task.force || v != "false"
+	case "meta":
+		task.keepMeta = task.keepMeta || v == "keep"
+	default:
+		return invalidParam(opt.op, k, "unknown param %q", k)
+	}
+	return err
+}
+
+func (t *Transform) tryCache(task *TransformTask) error {
+	info, err := os.Stat(task.cachePath)
+	if err != nil {
+		return err
+	}
+	t.cache.Touch(task.cachePath, info)
+	return serveFile(task.ctx, task.cachePath, task.contentType())
+}
+
+func (t *Transform) saveCache(task *TransformTask) error {
 	if task.result == nil || len(task.result) < 1 {
 		return errors.New("empty result")
 	}
 
-	return os.WriteFile(task.cachePath, task.result, os.ModePerm)
+	return t.cache.Save(task.cachePath, task.result)
 }
 
+// fallback serves the source file from disk, the metadata of jpeg, png and
+// webp files is stripped while they are streamed. The other images which
+// may carry metadata are refused if it should be stripped.
 func fallback(task *TransformTask) error {
-	info, file, err := task.inputFile.getFileInfo()
+	file, err := os.Open(task.inputFile.path)
 	if err != nil {
 		return err
 	}
-	http.ServeContent(task.ctx.Response(), task.ctx.Request(), info.Name(), info.ModTime(), bytes.NewReader(file))
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if task.strip != StripNone {
+		head := make([]byte, stripHeadSize)
+		n, _ := io.ReadFull(file, head)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if isStrippable(head[:n]) {
+			task.log.Debugf("strip metadata with mode %s", StripModeNames[task.strip])
+			return serveStripped(task, file, info, head[:n])
+		}
+		if mtype, err := task.inputFile.detectMimeType(); err == nil && !isMetadataFree(mtype) {
+			task.log.Warnf("refuse %s, its metadata can't be stripped", mtype)
+			return writeTransformError(task.ctx, unsupportedSource("metadata of %s can't be stripped", mtype))
+		}
+	}
+
+	http.ServeContent(task.ctx.Response(), task.ctx.Request(), info.Name(), info.ModTime(), file)
 	return nil
 }
 
-func serveFile(ctx echo.Context, path string) error {
+// serveStripped streams file without its metadata, the size is unknown
+// until it is written so ranges are not supported.
+func serveStripped(task *TransformTask, file *os.File, info os.FileInfo, head []byte) error {
+	req := task.ctx.Request()
+	resp := task.ctx.Response()
+
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+	if since, err := http.ParseTime(req.Header.Get(echo.HeaderIfModifiedSince)); err == nil && !modTime.After(since) {
+		resp.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	contentType := FormatToMimeType[JPEG]
+	if bytes.HasPrefix(head, pngSignature) {
+		contentType = FormatToMimeType[PNG]
+	} else if isWebP(head) {
+		contentType = FormatToMimeType[WEBP]
+	}
+	resp.Header().Set(echo.HeaderContentType, contentType)
+	resp.Header().Set(echo.HeaderLastModified, modTime.Format(http.TimeFormat))
+	resp.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+
+	if err := stripMetadata(resp, file, task.strip); err != nil {
+		task.log.Warnf("stream stripped file fail: %v", err)
+	}
+	return nil
+}
+
+// copyMeta copies the exif of the source to a jpeg result, the location is
+// removed by the strip mode and the orientation is reset since the result
+// has been rotated already.
+func copyMeta(task *TransformTask) {
+	mode := task.strip
+	if mode == StripAll || len(task.ops) == 0 || task.ops[len(task.ops)-1].format != JPEG {
+		return
+	}
+
+	// the exif segment is at most 64k and comes first
+	file, err := task.inputFile.head(jpegExifScanSize)
+	if err != nil {
+		return
+	}
+	tiff := jpegExif(file)
+	if tiff == nil {
+		return
+	}
+	if mode == StripLocation {
+		blankGPS(tiff)
+	}
+	setTIFFOrientation(tiff, 1)
+	task.result = insertJPEGExif(task.result, tiff)
+}
+
+// contentType returns the mime type of the result, which can't be sniffed
+// from the cache file for all formats.
+func (task *TransformTask) contentType() string {
+	if len(task.ops) == 0 {
+		return ""
+	}
+	if task.ops[len(task.ops)-1].vtt != "" {
+		return "text/vtt; charset=utf-8"
+	}
+	return FormatToMimeType[task.ops[len(task.ops)-1].format]
+}
+
+func serveFile(ctx echo.Context, path string, contentType string) error {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
 		return err
@@ -385,6 +996,9 @@ func serveFile(ctx echo.Context, path string) error {
 	}
 	defer file.Close()
 
+	if contentType != "" {
+		ctx.Response().Header().Set(echo.HeaderContentType, contentType)
+	}
 	http.ServeContent(ctx.Response(), ctx.Request(), fileInfo.Name(), fileInfo.ModTime(), file)
 
 	return nil
@@ -404,6 +1018,46 @@ func getOpKey(op *TransformOp) string {
 		"quality":  intKey(op.quality),
 		"format":   string(op.format),
 		"framenum": intKey(op.framenum),
+		"x":        intKey(op.x),
+		"y":        intKey(op.y),
+		"gravity":  op.gravity,
+		"dir":      op.dir,
+		"fit":      op.fit,
+		"bg":       op.bg,
+	}
+	if op.name != "" {
+		params["name"] = op.name
+		params["version"] = op.version
+	}
+	if op.opacity >= 0 {
+		params["opacity"] = strconv.FormatFloat(op.opacity, 'f', -1, 64)
+	}
+	if op.scale != 0 {
+		params["scale"] = strconv.FormatFloat(op.scale, 'f', -1, 64)
+	}
+	if op.margin != 0 {
+		params["margin"] = strconv.Itoa(op.margin)
+	}
+	if op.value != 0 {
+		params["v"] = strconv.FormatFloat(op.value, 'f', -1, 64)
+	}
+	if op.angle != 0 {
+		params["angle"] = strconv.FormatFloat(op.angle, 'f', -1, 64)
+	}
+	if op.lossless {
+		params["lossless"] = "1"
+	}
+	if op.enlarge {
+		params["enlarge"] = "1"
+	}
+	if op.hasTime {
+		params["time"] = strconv.FormatFloat(op.time, 'f', -1, 64)
+	}
+	if op.count != 0 {
+		params["n"] = strconv.Itoa(op.count)
+	}
+	if op.cols != 0 {
+		params["cols"] = strconv.Itoa(op.cols)
 	}
 
 	sortItems := make([]string, 0, len(params))
@@ -422,16 +1076,28 @@ func getOpKey(op *TransformOp) string {
 	return strings.Join(sortItems, urlQueryParamValueSep)
 }
 
-func getKey(path string, keys []string) string {
-	name, err := filepath.Rel(config.C.Dir, path)
-	if err != nil {
-		name = path
-	}
+// Invalidate removes all cached results of the source file rel.
+func (t *Transform) Invalidate(rel string) {
+	t.cache.Invalidate(getSourceKey(rel))
+}
+
+// getKey returns the cache key of the ops on path, the key is prefixed
+// with the key of the source file so the results can be invalidated. The
+// mtime and size of the source are part of the key, so a replaced source
+// never gets the results of the old one.
+func getKey(path string, info os.FileInfo, keys []string) string {
+	name := getRelSlashPath(path)
 
-	keyStr := fmt.Sprintf("%s?%s=%s", name, urlQueryParamKey, strings.Join(keys, urlQueryParamSep))
+	keyStr := fmt.Sprintf("%s#%d#%d?%s=%s", name, info.ModTime().UnixNano(), info.Size(), urlQueryParamKey, strings.Join(keys, urlQueryParamSep))
 
 	h := md5.New()
 	h.Write([]byte(keyStr))
-	return hex.EncodeToString(h.Sum(nil))
+	return getSourceKey(name) + "-" + hex.EncodeToString(h.Sum(nil))
 
 }
+
+func getSourceKey(rel string) string {
+	h := md5.New()
+	h.Write([]byte(rel))
+	return hex.EncodeToString(h.Sum(nil))
+}
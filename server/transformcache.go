@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"io/fs"
+	"mama/config"
+	"mama/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TRANSFORM_CACHE_DIR = "transform"
+
+	// the access time of a cache file is its mtime, it is updated at most
+	// once in the interval to save writes
+	cacheTouchInterval = time.Minute
+)
+
+// TransformCache keeps the transform results in dir/<key[:2]>/<key>, the
+// least recently used files are removed when it is larger than maxSize,
+// and files not used in maxAge are removed too.
+type TransformCache struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	// bytes written since the last prune
+	written atomic.Int64
+	prune   chan struct{}
+	mu      sync.Mutex
+}
+
+type TransformCacheStats struct {
+	Files  int       `json:"files"`
+	Size   int64     `json:"size"`
+	Oldest time.Time `json:"oldest"`
+	Newest time.Time `json:"newest"`
+}
+
+type cacheFile struct {
+	path  string
+	size  int64
+	atime time.Time
+}
+
+func NewTransformCache(dir string, maxSize int64, maxAge time.Duration) *TransformCache {
+	os.MkdirAll(dir, 0755)
+	return &TransformCache{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		prune:   make(chan struct{}, 1),
+	}
+}
+
+// OpenTransformCache opens the transform cache of config.C.Dir.
+func OpenTransformCache() *TransformCache {
+	return NewTransformCache(filepath.Join(config.C.Dir, CACHE_DIR, TRANSFORM_CACHE_DIR), config.C.Transform.CacheMaxSize, config.C.Transform.CacheMaxAge)
+}
+
+// Run prunes the cache every interval, or once a tenth of maxSize has been
+// written since the last prune.
+func (c *TransformCache) Run(ctx context.Context, interval time.Duration) {
+	logger := log.L.WithNewPrefix("transform cache")
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.prune:
+		}
+		if removed, freed, err := c.Prune(); err != nil {
+			logger.Warnf("prune fail: %v", err)
+		} else if removed > 0 {
+			logger.Infof("pruned %d files, %d bytes freed", removed, freed)
+		}
+	}
+}
+
+func (c *TransformCache) Path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Save writes data to the cache file at path.
+func (c *TransformCache) Save(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// the flights of a key may overlap, each writes its own tmp file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		os.Chmod(tmp.Name(), 0644)
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if c.maxSize > 0 && c.written.Add(int64(len(data))) > c.maxSize/10 {
+		select {
+		case c.prune <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Touch marks the cache file at path as used.
+func (c *TransformCache) Touch(path string, info fs.FileInfo) {
+	now := time.Now()
+	if now.Sub(info.ModTime()) > cacheTouchInterval {
+		os.Chtimes(path, now, now)
+	}
+}
+
+// Invalidate removes the cache files of the source with sourceKey.
+func (c *TransformCache) Invalidate(sourceKey string) {
+	files, _ := filepath.Glob(filepath.Join(c.dir, sourceKey[:2], sourceKey+"-*"))
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			log.Warnf("remove cache %s fail: %v", f, err)
+		}
+	}
+}
+
+func (c *TransformCache) files() ([]*cacheFile, error) {
+	files := []*cacheFile{}
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, &cacheFile{path: path, size: info.Size(), atime: info.ModTime()})
+		return nil
+	})
+
+	// results were kept in the parent dir as md5 hex names before
+	legacy, _ := os.ReadDir(filepath.Dir(c.dir))
+	for _, d := range legacy {
+		if d.IsDir() || !isLegacyCacheName(d.Name()) {
+			continue
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, &cacheFile{path: filepath.Join(filepath.Dir(c.dir), d.Name()), size: info.Size(), atime: info.ModTime()})
+		}
+	}
+	return files, err
+}
+
+func isLegacyCacheName(name string) bool {
+	if len(name) != 32 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *TransformCache) Stats() (*TransformCacheStats, error) {
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &TransformCacheStats{Files: len(files)}
+	for _, f := range files {
+		stats.Size += f.size
+		if stats.Oldest.IsZero() || f.atime.Before(stats.Oldest) {
+			stats.Oldest = f.atime
+		}
+		if f.atime.After(stats.Newest) {
+			stats.Newest = f.atime
+		}
+	}
+	return stats, nil
+}
+
+// Prune removes the files older than maxAge, then the least recently used
+// files until the cache is not larger than maxSize.
+func (c *TransformCache) Prune() (int, int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written.Store(0)
+
+	files, err := c.files()
+	if err != nil {
+		return 0, 0, err
+	}
+	sort.Slice(files, func(i int, j int) bool {
+		return files[i].atime.Before(files[j].atime)
+	})
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	removed := 0
+	var freed int64
+	expire := time.Now().Add(-c.maxAge)
+	for _, f := range files {
+		if !(c.maxAge > 0 && f.atime.Before(expire)) && !(c.maxSize > 0 && total > c.maxSize) {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("remove cache %s fail: %v", f.path, err)
+			continue
+		}
+		removed++
+		freed += f.size
+		total -= f.size
+	}
+
+	return removed, freed, nil
+}
+
+// Clear removes all the cache files.
+func (c *TransformCache) Clear() (int, int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files, err := c.files()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := 0
+	var freed int64
+	for _, f := range files {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return removed, freed, err
+		}
+		removed++
+		freed += f.size
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransformCachePrune(t *testing.T) {
+	now := time.Now()
+	// results were kept in the parent dir by older versions
+	legacy := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name    string
+		maxSize int64
+		maxAge  time.Duration
+		kept    []string
+	}{
+		{"unbounded", 0, 0, []string{legacy, "a", "b", "c", "d"}},
+		{"max age", 0, 90 * time.Minute, []string{"c", "d"}},
+		{"max size", 250, 0, []string{"c", "d"}},
+		{"max size fits", 500, 0, []string{legacy, "a", "b", "c", "d"}},
+		{"both", 150, 90 * time.Minute, []string{"d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, TRANSFORM_CACHE_DIR)
+			c := NewTransformCache(dir, tt.maxSize, tt.maxAge)
+			cachePath := func(name string) string {
+				if name == legacy {
+					return filepath.Join(parent, name)
+				}
+				return filepath.Join(dir, name[:1], name)
+			}
+			// legacy is the least recently used, d the most
+			for i, name := range []string{legacy, "a", "b", "c", "d"} {
+				path := cachePath(name)
+				os.MkdirAll(filepath.Dir(path), 0755)
+				if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+					t.Fatal(err)
+				}
+				atime := now.Add(time.Duration(i-4) * time.Hour)
+				os.Chtimes(path, atime, atime)
+			}
+			// not cache files
+			os.WriteFile(filepath.Join(dir, "a", "e.tmp"), make([]byte, 1000), 0644)
+			os.WriteFile(filepath.Join(parent, "index.json"), make([]byte, 1000), 0644)
+			os.WriteFile(filepath.Join(parent, strings.ToUpper(legacy)), make([]byte, 1000), 0644)
+
+			removed, freed, err := c.Prune()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != 5-len(tt.kept) || freed != int64(removed)*100 {
+				t.Errorf("removed %d files and %d bytes, want %d files", removed, freed, 5-len(tt.kept))
+			}
+			for _, name := range tt.kept {
+				if _, err := os.Stat(cachePath(name)); err != nil {
+					t.Errorf("%s is removed", name)
+				}
+			}
+			if stats, _ := c.Stats(); stats.Files != len(tt.kept) {
+				t.Errorf("%d files left, want %d", stats.Files, len(tt.kept))
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	headerTransformFallback = "X-Transform-Fallback"
+
+	errCodeInvalidParam = "invalid_param"
+	errCodeUnknownOp    = "unknown_op"
+	errCodeForbidden    = "forbidden"
+	errCodeFailed       = "transform_failed"
+	errCodeTooLarge     = "image_too_large"
+	errCodeUnavailable  = "unavailable"
+	errCodeUnsupported  = "unsupported_source"
+)
+
+// TransformError is returned to clients as {"error": {...}} in strict
+// mode, and its code is the X-Transform-Fallback header otherwise.
+type TransformError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Op      string `json:"op,omitempty"`
+	Param   string `json:"param,omitempty"`
+}
+
+func (e *TransformError) Error() string {
+	if e.Op != "" {
+		return fmt.Sprintf("%s: op %s: %s", e.Code, e.Op, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func invalidParam(op string, param string, format string, a ...any) *TransformError {
+	return &TransformError{
+		Status:  http.StatusBadRequest,
+		Code:    errCodeInvalidParam,
+		Message: fmt.Sprintf(format, a...),
+		Op:      op,
+		Param:   param,
+	}
+}
+
+// unsupportedSource is returned when the source can't be handled by an op,
+// e.g. a text file to resize or a video without duration.
+func unsupportedSource(format string, a ...any) *TransformError {
+	return &TransformError{
+		Status:  http.StatusUnsupportedMediaType,
+		Code:    errCodeUnsupported,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func writeTransformError(ctx echo.Context, err *TransformError) error {
+	return ctx.JSON(err.Status, map[string]*TransformError{"error": err})
+}
+
+// setErr keeps the first error of the task.
+func (task *TransformTask) setErr(err *TransformError) {
+	if task.err == nil {
+		task.err = err
+	}
+}
+
+func isFlagSet(ctx echo.Context, name string) bool {
+	values, ok := ctx.QueryParams()[name]
+	if !ok {
+		return false
+	}
+	return len(values) == 0 || (values[0] != "false" && values[0] != "0")
+}
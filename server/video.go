@@ -2,18 +2,24 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 
 	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
-func vedioSnapshot(path string, frameNum int) ([]byte, error) {
+// vedioSnapshot decodes the video up to frameNum, ffmpeg is killed when ctx
+// is done.
+func vedioSnapshot(ctx context.Context, path string, frameNum int) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
-	err := ffmpeg.Input(path).Filter("select", ffmpeg.Args{fmt.Sprintf("gte(n,%d)", frameNum)}).
-		Output("pipe:", ffmpeg.KwArgs{"vframes": 1, "format": "image2", "vcodec": "mjpeg"}).
-		WithOutput(buf, os.Stdout).
-		Run()
+	stream := ffmpeg.Input(path).Filter("select", ffmpeg.Args{fmt.Sprintf("gte(n,%d)", frameNum)}).
+		Output("pipe:", ffmpeg.KwArgs{"vframes": 1, "format": "image2", "vcodec": "mjpeg"})
+	stream.Context = ctx
+	err := stream.WithOutput(buf, os.Stdout).Run()
 	if err != nil {
 		return nil, err
 	}
@@ -21,3 +27,44 @@ func vedioSnapshot(path string, frameNum int) ([]byte, error) {
 	return buf.Bytes(), nil
 
 }
+
+// videoSnapshotAt seeks the input to seconds before decoding, which is much
+// faster than selecting a frame by number.
+func videoSnapshotAt(ctx context.Context, path string, seconds float64) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	stream := ffmpeg.Input(path, ffmpeg.KwArgs{"ss": strconv.FormatFloat(seconds, 'f', 3, 64)}).
+		Output("pipe:", ffmpeg.KwArgs{"vframes": 1, "format": "image2", "vcodec": "mjpeg"})
+	stream.Context = ctx
+	err := stream.WithOutput(buf, os.Stdout).Run()
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() == 0 {
+		return nil, invalidParam("", "time", "no frame at %gs", seconds)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// parseVideoTime parses seconds like 12.5 or a timestamp like 00:01:02.5.
+func parseVideoTime(v string) (float64, bool) {
+	seconds := 0.0
+	parts := strings.Split(v, ":")
+	if len(parts) > 3 {
+		return 0, false
+	}
+	for _, part := range parts {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+			return 0, false
+		}
+		seconds = seconds*60 + f
+	}
+	return seconds, true
+}
+
+// formatVTTTime formats seconds as hh:mm:ss.mmm.
+func formatVTTTime(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,46 @@
+package server
+
+import "testing"
+
+func TestParseVideoTime(t *testing.T) {
+	tests := []struct {
+		v    string
+		want float64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"12.5", 12.5, true},
+		{"1:02", 62, true},
+		{"1:00:01.25", 3601.25, true},
+		{"", 0, false},
+		{"1:2:3:4", 0, false},
+		{"-1", 0, false},
+		{"1:x", 0, false},
+		{"inf", 0, false},
+		{"NaN", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseVideoTime(tt.v)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseVideoTime(%q) = %v, %v, want %v, %v", tt.v, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatVTTTime(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "00:00:00.000"},
+		{1.5, "00:00:01.500"},
+		{59.9996, "00:01:00.000"},
+		{3661.001, "01:01:01.001"},
+		{360000, "100:00:00.000"},
+	}
+	for _, tt := range tests {
+		if got := formatVTTTime(tt.seconds); got != tt.want {
+			t.Errorf("formatVTTTime(%v) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+}
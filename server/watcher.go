@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"io/fs"
+	"mama/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// a rename is reported by inotify as a rename of the old path followed by
+	// a create of the new path, unpaired renames become deletes after this delay
+	renameWindow = 500 * time.Millisecond
+	// consecutive writes of the same file are reported as one modify
+	modifyDelay = 300 * time.Millisecond
+)
+
+// Watcher watches root recursively and emits the changes to handle, it
+// falls back to polling if inotify is not usable.
+type Watcher struct {
+	root         string
+	skip         string
+	pollInterval time.Duration
+	forcePoll    bool
+	handle       func(Event)
+	log          *log.Log
+}
+
+type pollState struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+func NewWatcher(root string, cacheDir string, pollInterval time.Duration, forcePoll bool, handle func(Event)) *Watcher {
+	return &Watcher{
+		root:         root,
+		skip:         cacheDir,
+		pollInterval: pollInterval,
+		forcePoll:    forcePoll,
+		handle:       handle,
+		log:          log.L.WithNewPrefix("watcher"),
+	}
+}
+
+func (w *Watcher) Run(ctx context.Context) {
+	if w.forcePoll {
+		w.poll(ctx)
+		return
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		w.log.Warnf("create inotify watcher fail, fallback to polling: %v", err)
+		w.poll(ctx)
+		return
+	}
+	defer fsw.Close()
+
+	if err := w.addRecursive(fsw, w.root, nil); err != nil {
+		w.log.Warnf("watch %s fail, fallback to polling: %v", w.root, err)
+		fsw.Close()
+		w.poll(ctx)
+		return
+	}
+	w.log.Infof("watching %s", w.root)
+
+	var (
+		renamed     = ""
+		renameTimer = time.NewTimer(0)
+		modified    = map[string]time.Time{}
+		modifyTick  = time.NewTicker(modifyDelay)
+	)
+	<-renameTimer.C
+	defer renameTimer.Stop()
+	defer modifyTick.Stop()
+
+	flushRename := func() {
+		if renamed != "" {
+			w.handle(Event{Type: EventDeleted, Path: renamed})
+			renamed = ""
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return
+			}
+			w.log.Warnf("inotify error: %v", err)
+
+		case <-renameTimer.C:
+			flushRename()
+
+		case now := <-modifyTick.C:
+			for rel, t := range modified {
+				if now.Sub(t) >= modifyDelay {
+					delete(modified, rel)
+					w.handle(Event{Type: EventModified, Path: rel})
+				}
+			}
+
+		case fev, ok := <-fsw.Events:
+			if !ok {
+				return
+			}
+			rel, ok := w.rel(fev.Name)
+			if !ok {
+				continue
+			}
+
+			switch {
+			case fev.Has(fsnotify.Create):
+				fi, err := os.Lstat(fev.Name)
+				if err != nil {
+					continue
+				}
+				if fi.IsDir() {
+					var visit func(string)
+					if renamed == "" {
+						// files created before the watch is added are reported as created too
+						visit = func(sub string) {
+							if subRel, ok := w.rel(sub); ok && subRel != rel {
+								w.handle(Event{Type: EventCreated, Path: subRel})
+							}
+						}
+					}
+					w.addRecursive(fsw, fev.Name, visit)
+				}
+				if renamed != "" {
+					renameTimer.Stop()
+					w.handle(Event{Type: EventRenamed, Path: rel, OldPath: renamed, IsDir: fi.IsDir()})
+					renamed = ""
+				} else {
+					w.handle(Event{Type: EventCreated, Path: rel, IsDir: fi.IsDir()})
+				}
+
+			case fev.Has(fsnotify.Write):
+				modified[rel] = time.Now()
+
+			case fev.Has(fsnotify.Remove):
+				delete(modified, rel)
+				w.handle(Event{Type: EventDeleted, Path: rel})
+
+			case fev.Has(fsnotify.Rename):
+				delete(modified, rel)
+				flushRename()
+				renamed = rel
+				renameTimer.Reset(renameWindow)
+			}
+		}
+	}
+}
+
+// addRecursive watches dir and all dirs below it, visit is called with
+// every path found.
+func (w *Watcher) addRecursive(fsw *fsnotify.Watcher, dir string, visit func(string)) error {
+	return filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if _, ok := w.rel(fpath); !ok && fpath != dir {
+			return filepath.SkipDir
+		}
+
+		if visit != nil {
+			visit(fpath)
+		}
+		if d.IsDir() {
+			return fsw.Add(fpath)
+		}
+		return nil
+	})
+}
+
+// poll compares snapshots of root every pollInterval, a deleted and a
+// created path with the same size and mtime are reported as renamed.
+func (w *Watcher) poll(ctx context.Context) {
+	if w.pollInterval <= 0 {
+		w.log.Warn("poll interval is zero, watcher disabled")
+		return
+	}
+	w.log.Infof("polling %s every %s", w.root, w.pollInterval)
+
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	last := w.snapshot()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := w.snapshot()
+		created := []string{}
+		for rel, st := range current {
+			old, ok := last[rel]
+			if !ok {
+				created = append(created, rel)
+			} else if !st.isDir && (old.size != st.size || !old.modTime.Equal(st.modTime)) {
+				w.handle(Event{Type: EventModified, Path: rel})
+			}
+		}
+
+		for rel, old := range last {
+			if _, ok := current[rel]; ok {
+				continue
+			}
+			renamed := false
+			for i, newRel := range created {
+				st := current[newRel]
+				if st.isDir == old.isDir && st.size == old.size && st.modTime.Equal(old.modTime) {
+					w.handle(Event{Type: EventRenamed, Path: newRel, OldPath: rel, IsDir: st.isDir})
+					created = append(created[:i], created[i+1:]...)
+					renamed = true
+					break
+				}
+			}
+			if !renamed {
+				w.handle(Event{Type: EventDeleted, Path: rel, IsDir: old.isDir})
+			}
+		}
+
+		for _, rel := range created {
+			w.handle(Event{Type: EventCreated, Path: rel, IsDir: current[rel].isDir})
+		}
+
+		last = current
+	}
+}
+
+func (w *Watcher) snapshot() map[string]pollState {
+	states := map[string]pollState{}
+	filepath.WalkDir(w.root, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, ok := w.rel(fpath)
+		if !ok {
+			if fpath == w.root {
+				return nil
+			}
+			return filepath.SkipDir
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		states[rel] = pollState{isDir: fi.IsDir(), size: fi.Size(), modTime: fi.ModTime()}
+		return nil
+	})
+	return states
+}
+
+// rel returns the slash separated path of fpath relative to root, root
+// itself and the cache dir are not reported.
+func (w *Watcher) rel(fpath string) (string, bool) {
+	rel, ok := relSlashPath(w.root, fpath)
+	if !ok || rel == "" || rel == w.skip || strings.HasPrefix(rel, w.skip+"/") {
+		return "", false
+	}
+	return rel, true
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"mama/config"
+	"mama/log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nao1215/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	opWatermark = "watermark"
+
+	defaultWatermarkFontSize = 24
+	defaultWatermarkGravity  = "bottomright"
+)
+
+var (
+	watermarkImages   = map[string]*watermarkImage{}
+	watermarkImagesMu sync.Mutex
+)
+
+type watermarkImage struct {
+	version string
+	img     image.Image
+}
+
+// transformWatermark overlays the configured watermark op.name at gravity,
+// scale is the width of the watermark relative to the image.
+func transformWatermark(op *TransformOp, log *log.Log) error {
+	log.Infof("start watermark with params: name=%s gravity=%s opacity=%g scale=%g margin=%d format=%s",
+		op.name, op.gravity, op.opacity, op.scale, op.margin, op.format)
+	wm, ok := config.C.Transform.Watermarks[op.name]
+	if !ok {
+		return fmt.Errorf("watermark %s not found", op.name)
+	}
+
+	return transformImage(op, log, func(img image.Image) (image.Image, error) {
+		width, height := imageSize(img)
+
+		var mark image.Image
+		if wm.Image != "" {
+			src, err := loadWatermarkImage(op.name, wm)
+			if err != nil {
+				return nil, err
+			}
+			mark = src
+			if op.scale > 0 {
+				mark = imaging.Resize(src, max(1, int(float64(width)*op.scale)), 0, imaging.Lanczos)
+			}
+		} else {
+			size := wm.FontSize
+			if size <= 0 {
+				size = defaultWatermarkFontSize
+			}
+			if op.scale > 0 {
+				// the text width is about proportional to the font size
+				textWidth, err := watermarkTextWidth(wm, size)
+				if err != nil {
+					return nil, err
+				}
+				if textWidth > 0 {
+					size = size * float64(width) * op.scale / float64(textWidth)
+				}
+			}
+			text, err := renderWatermarkText(wm, size)
+			if err != nil {
+				return nil, err
+			}
+			mark = text
+		}
+
+		opacity := op.opacity
+		if opacity < 0 {
+			opacity = 1
+		}
+		gravity := op.gravity
+		if gravity == "" {
+			gravity = defaultWatermarkGravity
+		}
+
+		markWidth, markHeight := imageSize(mark)
+		pos := anchorPoint(width, height, markWidth, markHeight, Anchors[gravity], op.margin)
+		return imaging.Overlay(img, mark, pos, opacity), nil
+	})
+}
+
+// validateWatermark checks the watermark is configured and sets its
+// version so the cached results change with the watermark.
+func validateWatermark(op *TransformOp) error {
+	wm, ok := config.C.Transform.Watermarks[op.name]
+	if !ok {
+		return fmt.Errorf("watermark %q is not configured", op.name)
+	}
+	op.version = watermarkVersion(wm)
+	return nil
+}
+
+// watermarkVersion changes with the config and the image file of the
+// watermark, it is part of the cache key.
+func watermarkVersion(wm config.Watermark) string {
+	if wm.Image != "" {
+		if info, err := os.Stat(watermarkPath(wm.Image)); err == nil {
+			return fmt.Sprintf("%s#%d#%d", wm.Image, info.ModTime().UnixNano(), info.Size())
+		}
+		return wm.Image
+	}
+	version := fmt.Sprintf("%s#%s#%g#%s", wm.Text, wm.Font, wm.FontSize, wm.Color)
+	if wm.Font != "" {
+		if info, err := os.Stat(watermarkPath(wm.Font)); err == nil {
+			version += fmt.Sprintf("#%d", info.ModTime().UnixNano())
+		}
+	}
+	return version
+}
+
+func watermarkPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(config.C.Dir, path)
+}
+
+func loadWatermarkImage(name string, wm config.Watermark) (image.Image, error) {
+	version := watermarkVersion(wm)
+
+	watermarkImagesMu.Lock()
+	defer watermarkImagesMu.Unlock()
+
+	if cached, ok := watermarkImages[name]; ok && cached.version == version {
+		return cached.img, nil
+	}
+
+	img, err := imaging.Open(watermarkPath(wm.Image), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("open watermark %s fail: %w", name, err)
+	}
+	watermarkImages[name] = &watermarkImage{version: version, img: img}
+	return img, nil
+}
+
+func watermarkFace(wm config.Watermark, size float64) (font.Face, error) {
+	data := goregular.TTF
+	if wm.Font != "" {
+		var err error
+		if data, err = os.ReadFile(watermarkPath(wm.Font)); err != nil {
+			return nil, err
+		}
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+func watermarkTextWidth(wm config.Watermark, size float64) (int, error) {
+	face, err := watermarkFace(wm, size)
+	if err != nil {
+		return 0, err
+	}
+	defer face.Close()
+	return font.MeasureString(face, wm.Text).Ceil(), nil
+}
+
+func renderWatermarkText(wm config.Watermark, size float64) (image.Image, error) {
+	face, err := watermarkFace(wm, size)
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	c, ok := parseColor(wm.Color)
+	if !ok {
+		c = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	}
+
+	metrics := face.Metrics()
+	width := max(1, font.MeasureString(face, wm.Text).Ceil())
+	height := max(1, (metrics.Ascent + metrics.Descent).Ceil())
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.Point26_6{X: 0, Y: metrics.Ascent},
+	}
+	d.DrawString(wm.Text)
+	return img, nil
+}
+
+// anchorPoint returns the position of a w x h box at anchor in a bw x bh
+// box, kept margin away from the edges.
+func anchorPoint(bw int, bh int, w int, h int, anchor imaging.Anchor, margin int) image.Point {
+	x := (bw - w) / 2
+	y := (bh - h) / 2
+	switch anchor {
+	case imaging.TopLeft, imaging.Left, imaging.BottomLeft:
+		x = margin
+	case imaging.TopRight, imaging.Right, imaging.BottomRight:
+		x = bw - w - margin
+	}
+	switch anchor {
+	case imaging.TopLeft, imaging.Top, imaging.TopRight:
+		y = margin
+	case imaging.BottomLeft, imaging.Bottom, imaging.BottomRight:
+		y = bh - h - margin
+	}
+	return image.Pt(x, y)
+}